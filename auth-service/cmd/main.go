@@ -11,10 +11,67 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to connect to MongoDB: %v", err)
 	}
+	if err := internal.EnsureIndexes(); err != nil {
+		log.Fatalf("Failed to create MongoDB indexes: %v", err)
+	}
+	if err := internal.InitSigningKeys(); err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+	internal.EnsureBootstrapAdmins()
+	internal.StartUsernameChangeWorker()
+	internal.StartAccountDeletionWorker()
+	internal.StartExportWorker()
 	
 	http.HandleFunc("/health", internal.HealthHandler)
 	http.HandleFunc("/login", internal.LoginHandler)
 	http.HandleFunc("/register", internal.RegisterHandler)
+	http.HandleFunc("/login/mfa", internal.LoginMFAHandler)
+	http.HandleFunc("/login/providers", internal.ExternalProvidersHandler)
+	http.HandleFunc("/login/external/", internal.ExternalLoginHandler)
+	http.HandleFunc("/login/external/exchange", internal.ExternalLoginExchangeHandler)
+	http.HandleFunc("/token/refresh", internal.RefreshTokenHandler)
+	http.HandleFunc("/logout", internal.LogoutHandler)
+	http.HandleFunc("/sessions", internal.AuthMiddleware(internal.SessionsHandler))
+	http.HandleFunc("/sessions/", internal.AuthMiddleware(internal.SessionHandler))
+	http.HandleFunc("/revocations", internal.RequireServiceKey(internal.RevocationsHandler))
+	http.HandleFunc("/.well-known/jwks.json", internal.JWKSHandler)
+	http.HandleFunc("/.well-known/openid-configuration", internal.DiscoveryHandler)
+	http.HandleFunc("/oauth/authorize", internal.AuthorizeHandler)
+	http.HandleFunc("/oauth/requests/", internal.AuthMiddleware(internal.AuthorizationRequestHandler))
+	http.HandleFunc("/oauth/token", internal.OAuthTokenHandler)
+	http.HandleFunc("/oauth/userinfo", internal.UserInfoHandler)
+	http.HandleFunc("/password/forgot", internal.ForgotPasswordHandler)
+	http.HandleFunc("/password/reset", internal.ResetPasswordHandler)
+	http.HandleFunc("/email/verify", internal.VerifyEmailHandler)
+	http.HandleFunc("/email/verify/resend", internal.AuthMiddleware(internal.ResendVerificationHandler))
+	http.HandleFunc("/mfa/totp/enroll", internal.AuthMiddleware(internal.TOTPEnrollHandler))
+	http.HandleFunc("/mfa/totp/confirm", internal.AuthMiddleware(internal.TOTPConfirmHandler))
+	http.HandleFunc("/mfa/totp/disable", internal.AuthMiddleware(internal.TOTPDisableHandler))
+	http.HandleFunc("/mfa/recovery-codes", internal.AuthMiddleware(internal.RecoveryCodesHandler))
+	http.HandleFunc("/tokens", internal.AuthMiddleware(internal.TokensHandler))
+	http.HandleFunc("/tokens/", internal.AuthMiddleware(internal.RevokeTokenHandler))
+	http.HandleFunc("/tokens/introspect", internal.RequireServiceKey(internal.IntrospectTokenHandler))
+	http.HandleFunc("/users/", internal.UserProfileHandler)
+	http.HandleFunc("/users/me", internal.AuthMiddleware(internal.MeHandler))
+	http.HandleFunc("/users/me/avatar", internal.AuthMiddleware(internal.MyAvatarHandler))
+	http.HandleFunc("/users/me/password", internal.AuthMiddleware(internal.ChangePasswordHandler))
+	http.HandleFunc("/users/me/username", internal.AuthMiddleware(internal.ChangeUsernameHandler))
+	http.HandleFunc("/users/me/deletion", internal.AuthMiddleware(internal.AccountDeletionHandler))
+	http.HandleFunc("/users/me/deletion/cancel", internal.AuthMiddleware(internal.CancelAccountDeletionHandler))
+	http.HandleFunc("/users/me/exports", internal.AuthMiddleware(internal.ExportsHandler))
+	http.HandleFunc("/users/me/exports/", internal.AuthMiddleware(internal.ExportHandler))
+	http.HandleFunc("/users/me/consents", internal.AuthMiddleware(internal.ConsentsHandler))
+	http.HandleFunc("/users/me/consents/", internal.AuthMiddleware(internal.ConsentHandler))
+	http.HandleFunc("/users/me/identities", internal.AuthMiddleware(internal.IdentitiesHandler))
+	http.HandleFunc("/users/me/identities/", internal.AuthMiddleware(internal.IdentityHandler))
+	http.HandleFunc("/users/me/security-events", internal.AuthMiddleware(internal.MySecurityEventsHandler))
+	http.HandleFunc("/avatars/", internal.AvatarHandler)
+	http.HandleFunc("/admin/users", internal.AuthMiddleware(internal.RequireRole(internal.AdminUsersHandler, internal.RoleAdmin)))
+	http.HandleFunc("/admin/users/", internal.AuthMiddleware(internal.RequireRole(internal.AdminUserHandler, internal.RoleAdmin)))
+	http.HandleFunc("/admin/audit", internal.AuthMiddleware(internal.RequireRole(internal.AdminAuditHandler, internal.RoleAdmin)))
+	http.HandleFunc("/admin/security-events", internal.AuthMiddleware(internal.RequireRole(internal.AdminSecurityEventsHandler, internal.RoleAdmin)))
+	http.HandleFunc("/admin/oauth/clients", internal.AuthMiddleware(internal.RequireRole(internal.AdminOAuthClientsHandler, internal.RoleAdmin)))
+	http.HandleFunc("/admin/oauth/clients/", internal.AuthMiddleware(internal.RequireRole(internal.AdminOAuthClientHandler, internal.RoleAdmin)))
 
 	log.Println("Auth service running on port 8081")
 	log.Fatal(http.ListenAndServe(":8081", nil))
@@ -0,0 +1,353 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Account deletion states. A deletion waits in scheduled until its grace
+// period is over, is running while a worker holds its lease and ends as
+// completed or cancelled. Failed erasures go back to scheduled for a retry.
+const (
+	DeletionScheduled = "scheduled"
+	DeletionRunning   = "running"
+	DeletionCompleted = "completed"
+	DeletionCancelled = "cancelled"
+)
+
+const (
+	erasurePending = "pending"
+	erasureDone    = "done"
+	erasureFailed  = "failed"
+)
+
+var (
+	accountDeletionGracePeriod   = durationFromEnv("ACCOUNT_DELETION_GRACE_PERIOD", 14*24*time.Hour)
+	accountDeletionCheckInterval = durationFromEnv("ACCOUNT_DELETION_CHECK_INTERVAL", time.Minute)
+	accountDeletionRetryInterval = durationFromEnv("ACCOUNT_DELETION_RETRY_INTERVAL", 10*time.Minute)
+	accountDeletionLease         = 15 * time.Minute
+)
+
+var (
+	ErrDeletionNotFound = errors.New("no account deletion pending")
+	ErrDeletionPending  = errors.New("account deletion already requested")
+	ErrDeletionStarted  = errors.New("account deletion has already started")
+)
+
+func accountDeletionCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("account_deletions")
+}
+
+// ScheduleAccountDeletion requests the deletion of user's account once the
+// grace period is over.
+func ScheduleAccountDeletion(ctx context.Context, user *User) (*AccountDeletion, error) {
+	if _, err := FindActiveDeletion(ctx, user.Username); err == nil {
+		return nil, ErrDeletionPending
+	} else if err != ErrDeletionNotFound {
+		return nil, err
+	}
+
+	services := map[string]*ErasureResult{"auth-service": {Status: erasurePending}}
+	for _, service := range downstreamServices() {
+		services[service.Name] = &ErasureResult{Status: erasurePending}
+	}
+
+	now := time.Now()
+	deletion := AccountDeletion{
+		Username:     user.Username,
+		Email:        user.Email,
+		Status:       DeletionScheduled,
+		RequestedAt:  now,
+		ScheduledFor: now.Add(accountDeletionGracePeriod),
+		Services:     services,
+	}
+	result, err := accountDeletionCollection().InsertOne(ctx, &deletion)
+	if err != nil {
+		return nil, err
+	}
+	return findDeletion(ctx, bson.M{"_id": result.InsertedID})
+}
+
+// FindActiveDeletion returns the scheduled or running deletion of username.
+func FindActiveDeletion(ctx context.Context, username string) (*AccountDeletion, error) {
+	return findDeletion(ctx, bson.M{
+		"username": username,
+		"status":   bson.M{"$in": []string{DeletionScheduled, DeletionRunning}},
+	})
+}
+
+func findDeletion(ctx context.Context, filter bson.M) (*AccountDeletion, error) {
+	var deletion AccountDeletion
+	err := accountDeletionCollection().FindOne(ctx, filter).Decode(&deletion)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrDeletionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &deletion, nil
+}
+
+// CancelAccountDeletion cancels a deletion that is still in its grace
+// period. Once erasure has started it can no longer be undone.
+func CancelAccountDeletion(ctx context.Context, username string) error {
+	result, err := accountDeletionCollection().UpdateOne(ctx,
+		bson.M{"username": username, "status": DeletionScheduled, "attempts": 0},
+		bson.M{"$set": bson.M{"status": DeletionCancelled, "cancelledAt": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		if _, err := FindActiveDeletion(ctx, username); err != nil {
+			return err
+		}
+		return ErrDeletionStarted
+	}
+	return nil
+}
+
+// claimDueDeletion takes the lease on one deletion whose grace period is
+// over, or whose previous worker died while holding the lease.
+func claimDueDeletion(ctx context.Context) (*AccountDeletion, error) {
+	now := time.Now()
+	filter := bson.M{"$or": []bson.M{
+		{"status": DeletionScheduled, "scheduledFor": bson.M{"$lte": now}},
+		{"status": DeletionRunning, "leaseUntil": bson.M{"$lt": now}},
+	}}
+	update := bson.M{
+		"$set": bson.M{"status": DeletionRunning, "leaseUntil": now.Add(accountDeletionLease)},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "scheduledFor", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var deletion AccountDeletion
+	err := accountDeletionCollection().FindOneAndUpdate(ctx, filter, update, opts).Decode(&deletion)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &deletion, nil
+}
+
+// runAccountDeletion erases the account in every service and then in
+// authdb. Services that already reported success are not called again.
+func runAccountDeletion(ctx context.Context, deletion *AccountDeletion) error {
+	collection := accountDeletionCollection()
+	if deletion.Services == nil {
+		deletion.Services = make(map[string]*ErasureResult)
+	}
+
+	// A rename still on its way to the services would recreate data under
+	// the name being erased, so wait for it first.
+	pending, err := renamePending(ctx, deletion.Username)
+	if err != nil {
+		return err
+	}
+	if pending {
+		return retryDeletionLater(ctx, deletion, "waiting for a username change to propagate")
+	}
+
+	// Sign the user out first so nothing new is created while we erase.
+	if err := RevokeUserSessions(ctx, deletion.Username); err != nil {
+		return err
+	}
+
+	failed := false
+	for _, service := range downstreamServices() {
+		if result := deletion.Services[service.Name]; result != nil && result.Status == erasureDone {
+			continue
+		}
+
+		var response struct {
+			Deleted map[string]int64 `json:"deleted"`
+		}
+		err := callService(ctx, service, "/internal/users/erase", map[string]string{"username": deletion.Username}, &response)
+		result := &ErasureResult{Status: erasureDone, Deleted: response.Deleted}
+		if err != nil {
+			log.Printf("Failed to erase %s in %s: %v", deletion.Username, service.Name, err)
+			result = &ErasureResult{Status: erasureFailed, Error: err.Error()}
+			failed = true
+		} else {
+			now := time.Now()
+			result.CompletedAt = &now
+		}
+		deletion.Services[service.Name] = result
+		if _, err := collection.UpdateByID(ctx, deletion.ID, bson.M{"$set": bson.M{"services." + service.Name: result}}); err != nil {
+			return err
+		}
+	}
+	if failed {
+		return retryDeletionLater(ctx, deletion, "")
+	}
+
+	deleted, err := eraseAuthData(ctx, deletion.Username)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	deletion.Services["auth-service"] = &ErasureResult{Status: erasureDone, Deleted: deleted, CompletedAt: &now}
+	deletion.Status = DeletionCompleted
+	deletion.CompletedAt = &now
+
+	_, err = collection.UpdateByID(ctx, deletion.ID, bson.M{
+		"$set": bson.M{
+			"status":                DeletionCompleted,
+			"completedAt":           now,
+			"services.auth-service": deletion.Services["auth-service"],
+		},
+		"$unset": bson.M{"leaseUntil": ""},
+	})
+	if err != nil {
+		return err
+	}
+
+	if deletion.Email != "" {
+		if err := GetMailSender().Send(deletion.Email, "Your account has been deleted", deletionReport(deletion)); err != nil {
+			log.Printf("Failed to mail deletion report for %s: %v", deletion.Username, err)
+		}
+	}
+	// The address was only kept to send the report.
+	_, err = collection.UpdateByID(ctx, deletion.ID, bson.M{"$unset": bson.M{"email": ""}})
+	return err
+}
+
+func retryDeletionLater(ctx context.Context, deletion *AccountDeletion, reason string) error {
+	if reason != "" {
+		log.Printf("Deferring deletion of %s: %s", deletion.Username, reason)
+	}
+	_, err := accountDeletionCollection().UpdateByID(ctx, deletion.ID, bson.M{
+		"$set":   bson.M{"status": DeletionScheduled, "scheduledFor": time.Now().Add(accountDeletionRetryInterval)},
+		"$unset": bson.M{"leaseUntil": ""},
+	})
+	return err
+}
+
+// eraseAuthData removes everything authdb holds about username and returns
+// the number of removed records per collection.
+func eraseAuthData(ctx context.Context, username string) (map[string]int64, error) {
+	deleted := make(map[string]int64)
+	db := Client.Database("authdb")
+
+	user, err := FindUserByUsername(ctx, username)
+	if err != nil && err != ErrUserNotFound {
+		return nil, err
+	}
+	if user != nil && user.Profile.AvatarKey != "" {
+		if err := GetBlobStore().Delete(ctx, user.Profile.AvatarKey); err != nil && err != ErrBlobNotFound {
+			return nil, err
+		}
+		deleted["avatars"] = 1
+	}
+
+	// The security event log is otherwise append-only. Events are matched by
+	// account ID too, so those recorded under an earlier username go as well;
+	// that needs the user document, hence before "users" below.
+	eventFilter := bson.M{"actor": username}
+	if user != nil {
+		eventFilter = bson.M{"$or": []bson.M{eventFilter, {"userId": user.ID}}}
+	}
+	result, err := securityEventCollection().DeleteMany(ctx, eventFilter)
+	if err != nil {
+		return nil, err
+	}
+	deleted["security_events"] = result.DeletedCount
+
+	for _, collection := range []string{"users", "refresh_tokens", "sessions", "access_tokens", "password_resets", "email_verifications", "mfa_challenges", "oauth_authorizations", "oauth_consents", "oauth_tokens", "external_logins"} {
+		result, err := db.Collection(collection).DeleteMany(ctx, bson.M{"username": username})
+		if err != nil {
+			return nil, err
+		}
+		deleted[collection] = result.DeletedCount
+	}
+
+	result, err = loginAttemptCollection().DeleteMany(ctx, bson.M{"key": accountAttemptKey(username)})
+	if err != nil {
+		return nil, err
+	}
+	deleted["login_attempts"] = result.DeletedCount
+
+	exports, err := DeleteUserExports(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	deleted["exports"] = exports
+
+	result, err = usernameChangeCollection().DeleteMany(ctx, bson.M{
+		"$or": []bson.M{{"oldUsername": username}, {"newUsername": username}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	deleted["username_changes"] = result.DeletedCount
+
+	// Access tokens issued before now stay on the deny-list until they expire.
+	return deleted, RevokeUserSessions(ctx, username)
+}
+
+// deletionReport is the final status report mailed once an account is gone.
+func deletionReport(deletion *AccountDeletion) string {
+	names := make([]string, 0, len(deletion.Services))
+	for name := range deletion.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hi %s,\n\nYour account was deleted on %s as requested on %s.\nThe following data was erased:\n\n",
+		deletion.Username, deletion.CompletedAt.Format(time.RFC1123), deletion.RequestedAt.Format(time.RFC1123))
+	for _, name := range names {
+		result := deletion.Services[name]
+		kinds := make([]string, 0, len(result.Deleted))
+		for kind := range result.Deleted {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		fmt.Fprintf(&b, "%s:\n", name)
+		for _, kind := range kinds {
+			fmt.Fprintf(&b, "  %s: %d\n", kind, result.Deleted[kind])
+		}
+	}
+	return b.String()
+}
+
+// StartAccountDeletionWorker carries out deletions whose grace period is over.
+func StartAccountDeletionWorker() {
+	go func() {
+		for {
+			processDueDeletions()
+			time.Sleep(accountDeletionCheckInterval)
+		}
+	}()
+}
+
+func processDueDeletions() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), accountDeletionLease)
+		deletion, err := claimDueDeletion(ctx)
+		if err != nil || deletion == nil {
+			if err != nil {
+				log.Printf("Account deletion worker failed: %v", err)
+			}
+			cancel()
+			return
+		}
+		if err := runAccountDeletion(ctx, deletion); err != nil {
+			log.Printf("Failed to delete account %s: %v", deletion.Username, err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,267 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// checkCurrentPassword re-authenticates the caller of a sensitive account
+// change. Wrong passwords count towards the login lockout, so a stolen
+// access token cannot be used to guess the password.
+func checkCurrentPassword(ctx context.Context, w http.ResponseWriter, r *http.Request, password string) (*User, bool) {
+	username := r.Header.Get("username")
+	ip := ClientIP(r)
+
+	wait, err := LoginLockedFor(ctx, username, ip)
+	if err != nil {
+		http.Error(w, "Login check failed", http.StatusInternalServerError)
+		return nil, false
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return nil, false
+	}
+
+	user, err := FindUserByUsername(ctx, username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil, false
+	}
+	// Accounts created through an external provider start without one.
+	if user.Password == "" {
+		http.Error(w, "This account has no password yet, set one through /password/forgot first", http.StatusConflict)
+		return nil, false
+	}
+	if !CheckPasswordHash(password, user.Password) {
+		if _, err := RecordLoginFailure(ctx, username, ip); err != nil {
+			log.Printf("Failed to record login failure for %s: %v", username, err)
+		}
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+// ChangePasswordHandler sets a new password. Every other session is signed
+// out and the caller gets a fresh token pair.
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.CurrentPassword == "" || request.NewPassword == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := checkCurrentPassword(ctx, w, r, request.CurrentPassword)
+	if !ok {
+		return
+	}
+	if violations := ValidatePassword(request.NewPassword, user.Username); len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	hashedPassword, err := HashPassword(request.NewPassword)
+	if err != nil {
+		http.Error(w, "Password hashing failed", http.StatusInternalServerError)
+		return
+	}
+	if err := UpdateUser(ctx, user.Username, bson.M{"password": hashedPassword, "passwordResetRequired": false}); err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := RevokeUserSessions(ctx, user.Username); err != nil {
+		log.Printf("Failed to revoke sessions for %s after password change: %v", user.Username, err)
+	}
+	RecordAuthEvent(r, EventPasswordChanged, user.Username, "success")
+
+	tokens, err := IssueTokenPair(ctx, r, user, "")
+	if err != nil {
+		http.Error(w, "JWT error", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// ChangeUsernameHandler renames the caller. The rename is applied to
+// auth-service right away and carried to the other services in the
+// background; the response lists the services that have not confirmed yet.
+func ChangeUsernameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		NewUsername string `json:"new_username"`
+		Password    string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.NewUsername == "" || request.Password == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if violations := ValidateUsername(request.NewUsername); len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	user, ok := checkCurrentPassword(ctx, w, r, request.Password)
+	if !ok {
+		return
+	}
+	if _, err := FindActiveDeletion(ctx, user.Username); err == nil {
+		http.Error(w, "Account is scheduled for deletion", http.StatusConflict)
+		return
+	}
+	if request.NewUsername == user.Username {
+		http.Error(w, "New username is the same as the current one", http.StatusBadRequest)
+		return
+	}
+
+	oldUsername := user.Username
+	change, err := RenameUser(ctx, oldUsername, request.NewUsername)
+	if err == ErrUsernameTaken {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to rename %s to %s: %v", oldUsername, request.NewUsername, err)
+		http.Error(w, "Username change failed", http.StatusInternalServerError)
+		return
+	}
+	RecordAuthEvent(r, EventUsernameChanged, request.NewUsername, "renamed from "+oldUsername)
+
+	// RenameUser woke the worker, which carries the change to the services.
+	user.Username = request.NewUsername
+	tokens, err := IssueTokenPair(ctx, r, user, "")
+	if err != nil {
+		http.Error(w, "JWT error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"username":         request.NewUsername,
+		"token":            tokens.Token,
+		"refresh_token":    tokens.RefreshToken,
+		"expires_in":       tokens.ExpiresIn,
+		"pending_services": change.Pending,
+	})
+}
+
+// deleteMe schedules the deletion of the caller's account. Nothing is erased
+// until the grace period is over, and the deletion can be cancelled until then.
+func deleteMe(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Password == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := checkCurrentPassword(ctx, w, r, request.Password)
+	if !ok {
+		return
+	}
+
+	deletion, err := ScheduleAccountDeletion(ctx, user)
+	if err == ErrDeletionPending {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to schedule deletion", http.StatusInternalServerError)
+		return
+	}
+	RecordAuthEvent(r, EventAccountDeletionRequested, user.Username, "scheduled")
+
+	if user.Email != "" {
+		body := fmt.Sprintf("Hi %s,\n\nYour account and everything you created will be deleted on %s.\n"+
+			"If you did not ask for this, sign in and cancel the deletion before then.",
+			user.Username, deletion.ScheduledFor.Format(time.RFC1123))
+		if err := GetMailSender().Send(user.Email, "Your account will be deleted", body); err != nil {
+			log.Printf("Failed to send deletion notice to %s: %v", user.Username, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(deletion)
+}
+
+// AccountDeletionHandler shows the caller's pending deletion at
+// GET /users/me/deletion.
+func AccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	deletion, err := FindActiveDeletion(ctx, r.Header.Get("username"))
+	if err == ErrDeletionNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get deletion", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deletion)
+}
+
+// CancelAccountDeletionHandler keeps the account if its deletion is still in
+// the grace period.
+func CancelAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	username := r.Header.Get("username")
+	err := CancelAccountDeletion(ctx, username)
+	switch err {
+	case nil:
+	case ErrDeletionNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case ErrDeletionStarted:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, "Failed to cancel deletion", http.StatusInternalServerError)
+		return
+	}
+	RecordAuthEvent(r, EventAccountDeletionCancelled, username, "cancelled")
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Account deletion cancelled"})
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Admin audit actions.
+const (
+	AdminActionSuspend            = "user.suspend"
+	AdminActionUnsuspend          = "user.unsuspend"
+	AdminActionForcePasswordReset = "user.force_password_reset"
+	AdminActionSetRoles           = "user.set_roles"
+	AdminActionCreateOAuthClient  = "oauth_client.create"
+	AdminActionDeleteOAuthClient  = "oauth_client.delete"
+)
+
+var (
+	ErrAccountSuspended      = errors.New("account suspended")
+	ErrPasswordResetRequired = errors.New("password reset required, check your email")
+)
+
+// CheckAccountUsable returns why user may not be given tokens, if anything.
+func CheckAccountUsable(user *User) error {
+	if user.Suspended {
+		return ErrAccountSuspended
+	}
+	if user.PasswordResetRequired {
+		return ErrPasswordResetRequired
+	}
+	return nil
+}
+
+// UserQuery filters and pages the admin user list.
+type UserQuery struct {
+	Search    string
+	Role      string
+	Suspended *bool
+	Page      int64
+	Limit     int64
+}
+
+// SearchUsers returns one page of users matching q, ordered by username,
+// and the total number of matches.
+func SearchUsers(ctx context.Context, q UserQuery) ([]User, int64, error) {
+	conditions := []bson.M{}
+	if q.Search != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(q.Search), Options: "i"}
+		conditions = append(conditions, bson.M{"$or": []bson.M{{"username": pattern}, {"email": pattern}}})
+	}
+	if q.Role != "" {
+		role := bson.M{"roles": q.Role}
+		for _, def := range DefaultRoles {
+			if def == q.Role {
+				// Accounts without stored roles have the default ones.
+				role = bson.M{"$or": []bson.M{{"roles": q.Role}, {"roles": bson.M{"$exists": false}}}}
+			}
+		}
+		conditions = append(conditions, role)
+	}
+	if q.Suspended != nil {
+		if *q.Suspended {
+			conditions = append(conditions, bson.M{"suspended": true})
+		} else {
+			conditions = append(conditions, bson.M{"suspended": bson.M{"$ne": true}})
+		}
+	}
+	filter := bson.M{}
+	if len(conditions) > 0 {
+		filter["$and"] = conditions
+	}
+
+	total, err := userCollection().CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "username", Value: 1}}).
+		SetCollation(caseInsensitive).
+		SetSkip((q.Page - 1) * q.Limit).
+		SetLimit(q.Limit)
+	cursor, err := userCollection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	users := make([]User, 0)
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// SuspendUser blocks username from getting tokens and ends their sessions,
+// which the other services pick up from the deny-list.
+func SuspendUser(ctx context.Context, username, reason string) error {
+	err := UpdateUser(ctx, username, bson.M{
+		"suspended":       true,
+		"suspendedAt":     time.Now(),
+		"suspendedReason": reason,
+	})
+	if err != nil {
+		return err
+	}
+	return RevokeUserSessions(ctx, username)
+}
+
+// UnsuspendUser lets username log in again.
+func UnsuspendUser(ctx context.Context, username string) error {
+	result, err := userCollection().UpdateOne(ctx,
+		bson.M{"username": username},
+		bson.M{"$unset": bson.M{"suspended": "", "suspendedAt": "", "suspendedReason": ""}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ForcePasswordReset blocks logins with the current password, ends every
+// session and mails the user a reset link.
+func ForcePasswordReset(ctx context.Context, user *User) error {
+	if err := UpdateUser(ctx, user.Username, bson.M{"passwordResetRequired": true}); err != nil {
+		return err
+	}
+	if err := RevokeUserSessions(ctx, user.Username); err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return nil
+	}
+	token, err := CreatePasswordReset(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	mailPasswordReset(user, token, "An administrator has asked you to choose a new password before you can sign in again.")
+	return nil
+}
+
+// SetUserRoles replaces username's roles and ends their sessions so that
+// tokens with the old roles stop working.
+func SetUserRoles(ctx context.Context, username string, roles []string) error {
+	if err := UpdateUser(ctx, username, bson.M{"roles": roles}); err != nil {
+		return err
+	}
+	return RevokeUserSessions(ctx, username)
+}
+
+func adminAuditCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("admin_audit")
+}
+
+// RecordAdminAction writes an audit entry for an action the admin making r
+// took on target.
+func RecordAdminAction(ctx context.Context, r *http.Request, action, target string, details map[string]interface{}) error {
+	_, err := adminAuditCollection().InsertOne(ctx, AdminAuditEntry{
+		Actor:     r.Header.Get("username"),
+		Action:    action,
+		Target:    target,
+		Details:   details,
+		IP:        ClientIP(r),
+		CreatedAt: time.Now(),
+	})
+	return err
+}
+
+// ListAdminAudit returns one page of audit entries, newest first, optionally
+// limited to one actor or target.
+func ListAdminAudit(ctx context.Context, actor, target string, page, limit int64) ([]AdminAuditEntry, int64, error) {
+	filter := bson.M{}
+	if actor != "" {
+		filter["actor"] = actor
+	}
+	if target != "" {
+		filter["target"] = target
+	}
+
+	total, err := adminAuditCollection().CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+		SetSkip((page - 1) * limit).
+		SetLimit(limit)
+	cursor, err := adminAuditCollection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	entries := make([]AdminAuditEntry, 0)
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
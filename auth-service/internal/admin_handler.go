@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	adminDefaultPageSize = 20
+	adminMaxPageSize     = 100
+)
+
+// pagination reads the "page" (from 1) and "limit" query parameters.
+func pagination(r *http.Request) (int64, int64) {
+	page, err := strconv.ParseInt(r.URL.Query().Get("page"), 10, 64)
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil || limit < 1 {
+		limit = adminDefaultPageSize
+	}
+	if limit > adminMaxPageSize {
+		limit = adminMaxPageSize
+	}
+	return page, limit
+}
+
+// recordAdminAction writes the audit entry for an action that has already
+// been carried out, so a failed write is logged rather than reported.
+func recordAdminAction(ctx context.Context, r *http.Request, action, target string, details map[string]interface{}) {
+	if err := RecordAdminAction(ctx, r, action, target, details); err != nil {
+		log.Printf("Failed to audit %s on %s by %s: %v", action, target, r.Header.Get("username"), err)
+	}
+}
+
+// AdminUsersHandler lists and searches users at GET /admin/users. Query
+// parameters: q (username or email), role, suspended, page and limit.
+func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := UserQuery{
+		Search: strings.TrimSpace(r.URL.Query().Get("q")),
+		Role:   r.URL.Query().Get("role"),
+	}
+	if v := r.URL.Query().Get("suspended"); v != "" {
+		suspended := v == "true"
+		query.Suspended = &suspended
+	}
+	query.Page, query.Limit = pagination(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	users, total, err := SearchUsers(ctx, query)
+	if err != nil {
+		http.Error(w, "Failed to get users", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users": users,
+		"total": total,
+		"page":  query.Page,
+		"limit": query.Limit,
+	})
+}
+
+// AdminUserHandler serves the per-user admin endpoints:
+//
+//	GET  /admin/users/{username}
+//	POST /admin/users/{username}/suspend
+//	POST /admin/users/{username}/unsuspend
+//	POST /admin/users/{username}/password-reset
+//	PUT  /admin/users/{username}/roles
+func AdminUserHandler(w http.ResponseWriter, r *http.Request) {
+	username, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/users/"), "/")
+	if username == "" {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := FindUserByUsername(ctx, username)
+	if err == ErrUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+
+	method := map[string]string{
+		"":               http.MethodGet,
+		"suspend":        http.MethodPost,
+		"unsuspend":      http.MethodPost,
+		"password-reset": http.MethodPost,
+		"roles":          http.MethodPut,
+	}
+	want, ok := method[action]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != want {
+		http.Error(w, "Only "+want+" allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+	case "suspend":
+		adminSuspend(ctx, w, r, user)
+	case "unsuspend":
+		if err := UnsuspendUser(ctx, user.Username); err != nil {
+			http.Error(w, "DB update error", http.StatusInternalServerError)
+			return
+		}
+		recordAdminAction(ctx, r, AdminActionUnsuspend, user.Username, nil)
+		json.NewEncoder(w).Encode(map[string]string{"message": "User unsuspended"})
+	case "password-reset":
+		if err := ForcePasswordReset(ctx, user); err != nil {
+			log.Printf("Failed to force password reset for %s: %v", user.Username, err)
+			http.Error(w, "Password reset failed", http.StatusInternalServerError)
+			return
+		}
+		recordAdminAction(ctx, r, AdminActionForcePasswordReset, user.Username, nil)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Password reset required, the user has been signed out"})
+	case "roles":
+		adminSetRoles(ctx, w, r, user)
+	}
+}
+
+func adminSuspend(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User) {
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Reason) == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+	if user.Username == r.Header.Get("username") {
+		http.Error(w, "You cannot suspend yourself", http.StatusBadRequest)
+		return
+	}
+
+	reason := strings.TrimSpace(request.Reason)
+	if err := SuspendUser(ctx, user.Username, reason); err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	recordAdminAction(ctx, r, AdminActionSuspend, user.Username, map[string]interface{}{"reason": reason})
+	json.NewEncoder(w).Encode(map[string]string{"message": "User suspended"})
+}
+
+func adminSetRoles(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User) {
+	var request struct {
+		Roles []string `json:"roles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Roles) == 0 {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	for _, role := range request.Roles {
+		if !IsValidRole(role) {
+			http.Error(w, "Unknown role: "+role, http.StatusBadRequest)
+			return
+		}
+	}
+	roles := uniqueStrings(request.Roles)
+
+	// Keep at least the acting admin able to manage roles.
+	if user.Username == r.Header.Get("username") {
+		keepsAdmin := false
+		for _, role := range roles {
+			keepsAdmin = keepsAdmin || role == RoleAdmin
+		}
+		if !keepsAdmin {
+			http.Error(w, "You cannot remove your own admin role", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := SetUserRoles(ctx, user.Username, roles); err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	recordAdminAction(ctx, r, AdminActionSetRoles, user.Username, map[string]interface{}{
+		"from": UserRoles(user),
+		"to":   roles,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"username": user.Username, "roles": roles})
+}
+
+// AdminAuditHandler lists admin actions at GET /admin/audit. Query
+// parameters: actor, target, page and limit.
+func AdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page, limit := pagination(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	entries, total, err := ListAdminAudit(ctx, r.URL.Query().Get("actor"), r.URL.Query().Get("target"), page, limit)
+	if err != nil {
+		http.Error(w, "Failed to get audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": entries,
+		"total":   total,
+		"page":    page,
+		"limit":   limit,
+	})
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// devServiceAPIKey is the service key outside production, so that services
+// started locally find each other without configuration.
+const devServiceAPIKey = "dev-service-api-key"
+
+// serviceAPIKey is the shared secret the other services present to call
+// auth-service's service endpoints, from SERVICE_API_KEY.
+func serviceAPIKey() string {
+	if key := os.Getenv("SERVICE_API_KEY"); key != "" {
+		return key
+	}
+	if os.Getenv("ENVIRONMENT") == "production" {
+		return ""
+	}
+	return devServiceAPIKey
+}
+
+// AuthMiddleware validates the bearer access token, rejects revoked tokens
+// and passes the username and roles on in the "username" and "roles" headers
+// like the other services. The token's session ID goes into "sid".
+func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenStr, ok := BearerToken(r)
+		if !ok {
+			http.Error(w, "Invalid authorization header", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := ParseJWT(tokenStr)
+		if err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		revoked, err := IsTokenRevoked(ctx, claims)
+		if err != nil {
+			http.Error(w, "Token check failed", http.StatusInternalServerError)
+			return
+		}
+		if revoked {
+			http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+			return
+		}
+
+		// id_tokens from the OIDC provider are signed with the same keys but
+		// carry no username; they are not access tokens.
+		username, _ := claims["username"].(string)
+		if username == "" {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		r.Header.Set("username", username)
+		r.Header.Set("roles", strings.Join(ClaimStrings(claims, "roles"), ","))
+		sid, _ := claims["sid"].(string)
+		r.Header.Set("sid", sid)
+		next(w, r)
+	}
+}
+
+// RequireServiceKey only lets through the other services, which send the
+// shared service key as a bearer token. Without a key configured in
+// production nobody is let through.
+func RequireServiceKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := serviceAPIKey()
+		token, ok := BearerToken(r)
+		if key == "" || !ok || subtle.ConstantTimeCompare([]byte(token), []byte(key)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
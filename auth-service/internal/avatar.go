@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+
+	_ "image/gif"
+	_ "image/jpeg"
+)
+
+var (
+	avatarMaxBytes     = int64(intFromEnv("AVATAR_MAX_BYTES", 5<<20))
+	avatarMaxDimension = intFromEnv("AVATAR_MAX_DIMENSION", 4096)
+	avatarSize         = intFromEnv("AVATAR_SIZE", 256)
+)
+
+var ErrInvalidAvatar = errors.New("avatar must be a PNG, JPEG or GIF image")
+
+// ProcessAvatar validates an uploaded image and returns it as a square PNG of
+// avatarSize pixels. The header is checked before decoding so oversized
+// images are rejected without allocating their pixels.
+func ProcessAvatar(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, avatarMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > avatarMaxBytes {
+		return nil, errors.New("avatar is too large")
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidAvatar
+	}
+	if format != "png" && format != "jpeg" && format != "gif" {
+		return nil, ErrInvalidAvatar
+	}
+	if config.Width < 1 || config.Height < 1 || config.Width > avatarMaxDimension || config.Height > avatarMaxDimension {
+		return nil, errors.New("avatar dimensions are out of range")
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidAvatar
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, resizeSquare(img, avatarSize)); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// resizeSquare crops the centre square of img and scales it to size x size,
+// averaging every source pixel that falls into a destination pixel.
+func resizeSquare(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	crop := image.Rect(0, 0, side, side)
+	src := image.NewRGBA(crop)
+	offset := image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2)
+	draw.Draw(src, crop, img, offset, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0 := y * side / size
+		y1 := (y + 1) * side / size
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < size; x++ {
+			x0 := x * side / size
+			x1 := (x + 1) * side / size
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint32(p[0])
+					g += uint32(p[1])
+					bl += uint32(p[2])
+					a += uint32(p[3])
+					n++
+				}
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0] = uint8(r / n)
+			d[1] = uint8(g / n)
+			d[2] = uint8(bl / n)
+			d[3] = uint8(a / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"context"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Failed logins are counted per account and per client IP. Once a counter
+// reaches its threshold every further failure locks the key for
+// loginLockoutBase * 2^(failures-threshold), capped at loginLockoutMax.
+// Counters are forgotten loginAttemptWindow after the last failure.
+var (
+	loginMaxAccountFailures = intFromEnv("LOGIN_MAX_ACCOUNT_FAILURES", 5)
+	loginMaxIPFailures      = intFromEnv("LOGIN_MAX_IP_FAILURES", 20)
+	loginLockoutBase        = durationFromEnv("LOGIN_LOCKOUT_BASE", 30*time.Second)
+	loginLockoutMax         = durationFromEnv("LOGIN_LOCKOUT_MAX", time.Hour)
+	loginAttemptWindow      = durationFromEnv("LOGIN_ATTEMPT_WINDOW", 24*time.Hour)
+
+	registerRateLimit  = intFromEnv("REGISTER_RATE_LIMIT", 5)
+	registerRateWindow = durationFromEnv("REGISTER_RATE_WINDOW", time.Hour)
+)
+
+func intFromEnv(key string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+func loginAttemptCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("login_attempts")
+}
+
+func accountAttemptKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// LoginLockedFor returns how long the caller still has to wait before the
+// account or IP may try again, or zero if neither is locked.
+func LoginLockedFor(ctx context.Context, username, ip string) (time.Duration, error) {
+	cursor, err := loginAttemptCollection().Find(ctx, bson.M{
+		"key":         bson.M{"$in": []string{accountAttemptKey(username), ipAttemptKey(ip)}},
+		"lockedUntil": bson.M{"$gt": time.Now()},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var attempts []LoginAttempt
+	if err := cursor.All(ctx, &attempts); err != nil {
+		return 0, err
+	}
+
+	var wait time.Duration
+	for _, a := range attempts {
+		if d := time.Until(*a.LockedUntil); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// RecordLoginFailure counts a failed login against the account and the IP
+// and returns the longest lockout that the failure triggered, if any.
+func RecordLoginFailure(ctx context.Context, username, ip string) (time.Duration, error) {
+	accountLock, err := recordFailure(ctx, accountAttemptKey(username), loginMaxAccountFailures)
+	if err != nil {
+		return 0, err
+	}
+	ipLock, err := recordFailure(ctx, ipAttemptKey(ip), loginMaxIPFailures)
+	if err != nil {
+		return 0, err
+	}
+	if ipLock > accountLock {
+		return ipLock, nil
+	}
+	return accountLock, nil
+}
+
+func recordFailure(ctx context.Context, key string, threshold int) (time.Duration, error) {
+	now := time.Now()
+	collection := loginAttemptCollection()
+
+	var attempt LoginAttempt
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"key": key},
+		bson.M{
+			"$inc": bson.M{"failures": 1},
+			"$set": bson.M{"lastFailureAt": now, "expiresAt": now.Add(loginAttemptWindow)},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&attempt)
+	if err != nil {
+		return 0, err
+	}
+
+	if attempt.Failures < threshold {
+		return 0, nil
+	}
+
+	exponent := float64(attempt.Failures - threshold)
+	lockout := time.Duration(float64(loginLockoutBase) * math.Pow(2, exponent))
+	if lockout > loginLockoutMax || lockout <= 0 {
+		lockout = loginLockoutMax
+	}
+
+	_, err = collection.UpdateOne(ctx, bson.M{"key": key}, bson.M{"$set": bson.M{"lockedUntil": now.Add(lockout)}})
+	if err != nil {
+		return 0, err
+	}
+	return lockout, nil
+}
+
+// ResetLoginFailures clears the account counter after a successful login.
+// The IP counter is left to expire so one good login cannot hide a spray.
+func ResetLoginFailures(ctx context.Context, username string) error {
+	_, err := loginAttemptCollection().DeleteOne(ctx, bson.M{"key": accountAttemptKey(username)})
+	return err
+}
+
+// AllowRegistration counts a registration attempt from ip and reports whether
+// it is within REGISTER_RATE_LIMIT per REGISTER_RATE_WINDOW.
+func AllowRegistration(ctx context.Context, ip string) (bool, error) {
+	now := time.Now()
+	key := "register:" + ip
+	collection := loginAttemptCollection()
+
+	var attempt LoginAttempt
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"key": key, "expiresAt": bson.M{"$gt": now}},
+		bson.M{"$inc": bson.M{"failures": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&attempt)
+	if err == mongo.ErrNoDocuments {
+		// No live window for this IP yet, start one.
+		_, err = collection.UpdateOne(ctx,
+			bson.M{"key": key},
+			bson.M{"$set": bson.M{"failures": 1, "lastFailureAt": now, "expiresAt": now.Add(registerRateWindow)}},
+			options.Update().SetUpsert(true),
+		)
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	return attempt.Failures <= registerRateLimit, nil
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var emailVerificationTTL = durationFromEnv("EMAIL_VERIFICATION_TTL", 48*time.Hour)
+
+var ErrInvalidVerificationToken = errors.New("invalid or expired verification token")
+
+func emailVerificationCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("email_verifications")
+}
+
+// SendVerificationEmail issues a new verification token for the user's
+// current email address and mails the verification link.
+func SendVerificationEmail(ctx context.Context, user *User) error {
+	token, err := GenerateRandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	collection := emailVerificationCollection()
+	if _, err := collection.DeleteMany(ctx, bson.M{"username": user.Username}); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = collection.InsertOne(ctx, EmailVerification{
+		TokenHash: HashToken(token),
+		Username:  user.Username,
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(emailVerificationTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := appBaseURL() + "/verify-email?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening the link below. It expires in %s.\n\n%s",
+		user.Username, emailVerificationTTL, link)
+	return GetMailSender().Send(user.Email, "Verify your email address", body)
+}
+
+// VerifyEmail consumes a verification token and marks the address it was
+// issued for as verified, provided the user has not changed it since.
+func VerifyEmail(ctx context.Context, token string) (string, error) {
+	var verification EmailVerification
+	err := emailVerificationCollection().FindOneAndDelete(ctx, bson.M{
+		"tokenHash": HashToken(token),
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&verification)
+	if err == mongo.ErrNoDocuments {
+		return "", ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	result, err := userCollection().UpdateOne(ctx,
+		bson.M{"username": verification.Username, "email": verification.Email},
+		bson.M{"$set": bson.M{"emailVerified": true}},
+	)
+	if err != nil {
+		return "", err
+	}
+	if result.MatchedCount == 0 {
+		return "", ErrInvalidVerificationToken
+	}
+	return verification.Username, nil
+}
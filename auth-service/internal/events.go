@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Auth event types.
+const (
+	EventRegistered        = "register.succeeded"
+	EventRegisterThrottled = "register.throttled"
+	EventLoginSucceeded    = "login.succeeded"
+	EventLoginFailed       = "login.failed"
+	EventLoginLockedOut    = "login.locked_out"
+	EventLoginRefused      = "login.refused"
+	EventMFAFailed         = "login.mfa_failed"
+	EventExternalLogin     = "login.external"
+	EventTokenIssued       = "token.issued"
+	EventRefreshReused     = "token.refresh_reused"
+	EventPasswordChanged   = "password.changed"
+	EventPasswordReset     = "password.reset"
+	EventUsernameChanged   = "username.changed"
+	EventMFAEnabled        = "mfa.enabled"
+	EventMFADisabled       = "mfa.disabled"
+	EventSessionRevoked    = "session.revoked"
+	EventLogoutEverywhere  = "session.logout_everywhere"
+	EventIdentityLinked    = "identity.linked"
+	EventIdentityUnlinked  = "identity.unlinked"
+
+	EventAccountDeletionRequested = "account.deletion_requested"
+	EventAccountDeletionCancelled = "account.deletion_cancelled"
+)
+
+// securityEventRetention is how long security events are kept.
+var securityEventRetention = durationFromEnv("SECURITY_EVENT_RETENTION", 365*24*time.Hour)
+
+func securityEventCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("security_events")
+}
+
+// RecordAuthEvent records a security relevant event about the account
+// username in the security event log. The account need not exist, e.g. for
+// a failed login with a mistyped name. Failing to store the event does not
+// fail the request; the event is logged either way.
+func RecordAuthEvent(r *http.Request, eventType, username, outcome string) {
+	log.Printf("auth event type=%s user=%q ip=%s outcome=%s user_agent=%q",
+		eventType, username, ClientIP(r), outcome, r.UserAgent())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	event := SecurityEvent{
+		Type:      eventType,
+		Actor:     username,
+		IP:        ClientIP(r),
+		UserAgent: r.UserAgent(),
+		Outcome:   outcome,
+		CreatedAt: now,
+		ExpiresAt: now.Add(securityEventRetention),
+	}
+	// Events point at the account ID so they stay with the user across
+	// username changes without being rewritten.
+	if user, err := FindUserByUsername(ctx, username); err == nil && !user.ID.IsZero() {
+		event.Actor = user.Username
+		event.UserID = &user.ID
+	}
+	if _, err := securityEventCollection().InsertOne(ctx, event); err != nil {
+		log.Printf("Failed to store auth event %s for %q: %v", eventType, username, err)
+	}
+}
+
+// SecurityEventQuery narrows down the security event log. Zero fields match
+// everything.
+type SecurityEventQuery struct {
+	// Username matches events recorded under that name and, if the account
+	// exists, all events of the account, including those from before a
+	// rename.
+	Username string
+	UserID   primitive.ObjectID
+	Types    []string
+	From     time.Time
+	To       time.Time
+}
+
+// ListSecurityEvents returns one page of security events, newest first.
+func ListSecurityEvents(ctx context.Context, q SecurityEventQuery, page, limit int64) ([]SecurityEvent, int64, error) {
+	filter := bson.M{}
+	if q.Username != "" {
+		actor := []bson.M{{"actor": q.Username}}
+		user, err := FindUserByUsername(ctx, q.Username)
+		if err != nil && err != ErrUserNotFound {
+			return nil, 0, err
+		}
+		if user != nil && !user.ID.IsZero() {
+			actor = append(actor, bson.M{"userId": user.ID})
+		}
+		filter["$or"] = actor
+	}
+	if !q.UserID.IsZero() {
+		filter["userId"] = q.UserID
+	}
+	if len(q.Types) > 0 {
+		filter["type"] = bson.M{"$in": q.Types}
+	}
+	createdAt := bson.M{}
+	if !q.From.IsZero() {
+		createdAt["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		createdAt["$lt"] = q.To
+	}
+	if len(createdAt) > 0 {
+		filter["createdAt"] = createdAt
+	}
+
+	total, err := securityEventCollection().CountDocuments(ctx, filter, options.Count().SetCollation(caseInsensitive))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetCollation(caseInsensitive).
+		SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+		SetSkip((page - 1) * limit).
+		SetLimit(limit)
+	cursor, err := securityEventCollection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	events := make([]SecurityEvent, 0)
+	if err = cursor.All(ctx, &events); err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
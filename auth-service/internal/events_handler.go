@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// parseEventTime reads an RFC 3339 time from query parameter key; a missing
+// parameter is the zero time.
+func parseEventTime(r *http.Request, key string) (time.Time, bool) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return time.Time{}, true
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, err == nil
+}
+
+// AdminSecurityEventsHandler searches the security event log at GET
+// /admin/security-events. Query parameters: user, type (comma separated),
+// from and to (RFC 3339), page and limit.
+func AdminSecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := SecurityEventQuery{Username: strings.TrimSpace(r.URL.Query().Get("user"))}
+	for _, t := range strings.Split(r.URL.Query().Get("type"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			query.Types = append(query.Types, t)
+		}
+	}
+	var fromOK, toOK bool
+	query.From, fromOK = parseEventTime(r, "from")
+	query.To, toOK = parseEventTime(r, "to")
+	if !fromOK || !toOK {
+		http.Error(w, "from and to must be RFC 3339 times", http.StatusBadRequest)
+		return
+	}
+
+	page, limit := pagination(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events, total, err := ListSecurityEvents(ctx, query, page, limit)
+	if err != nil {
+		http.Error(w, "Failed to get security events", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events": events,
+		"total":  total,
+		"page":   page,
+		"limit":  limit,
+	})
+}
+
+// MySecurityEventsHandler shows the caller's recent security activity at GET
+// /users/me/security-events, newest first. Query parameters: page and limit.
+func MySecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page, limit := pagination(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := FindUserByUsername(ctx, r.Header.Get("username"))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	events, total, err := ListSecurityEvents(ctx, SecurityEventQuery{UserID: user.ID}, page, limit)
+	if err != nil {
+		http.Error(w, "Failed to get security events", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events": events,
+		"total":  total,
+		"page":   page,
+		"limit":  limit,
+	})
+}
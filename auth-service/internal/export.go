@@ -0,0 +1,568 @@
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Export job states. Jobs whose sources fail go back to queued until
+// exportMaxAttempts is reached.
+const (
+	ExportQueued    = "queued"
+	ExportRunning   = "running"
+	ExportCompleted = "completed"
+	ExportFailed    = "failed"
+)
+
+const (
+	exportPartPending = "pending"
+	exportPartDone    = "done"
+	exportPartFailed  = "failed"
+	exportMaxAttempts = 5
+	exportLease       = 10 * time.Minute
+)
+
+var (
+	exportTTL           = durationFromEnv("EXPORT_TTL", 7*24*time.Hour)
+	exportCheckInterval = durationFromEnv("EXPORT_CHECK_INTERVAL", 30*time.Second)
+	exportRetryInterval = durationFromEnv("EXPORT_RETRY_INTERVAL", 5*time.Minute)
+)
+
+var (
+	ErrExportNotFound = errors.New("export not found")
+	ErrExportPending  = errors.New("an export is already in progress")
+	ErrExportNotReady = errors.New("export is not ready")
+)
+
+// exportWake starts the worker early when a job is queued.
+var exportWake = make(chan struct{}, 1)
+
+func exportCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("exports")
+}
+
+func exportPartKey(jobID primitive.ObjectID, part string) string {
+	return "exports/" + jobID.Hex() + "/" + part + ".json"
+}
+
+func exportArchiveKey(jobID primitive.ObjectID) string {
+	return "exports/" + jobID.Hex() + "/takeout.zip"
+}
+
+// CreateExportJob queues an export of everything username created.
+func CreateExportJob(ctx context.Context, username string) (*ExportJob, error) {
+	count, err := exportCollection().CountDocuments(ctx, bson.M{
+		"username": username,
+		"status":   bson.M{"$in": []string{ExportQueued, ExportRunning}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrExportPending
+	}
+
+	parts := map[string]*ExportPart{"auth-service": {Status: exportPartPending}}
+	for _, service := range downstreamServices() {
+		parts[service.Name] = &ExportPart{Status: exportPartPending}
+	}
+
+	now := time.Now()
+	job := ExportJob{
+		ID:        primitive.NewObjectID(),
+		Username:  username,
+		Status:    ExportQueued,
+		Parts:     parts,
+		RunAfter:  now,
+		CreatedAt: now,
+	}
+	if _, err := exportCollection().InsertOne(ctx, &job); err != nil {
+		return nil, err
+	}
+
+	select {
+	case exportWake <- struct{}{}:
+	default:
+	}
+	return &job, nil
+}
+
+// FindExportJob returns one of username's export jobs.
+func FindExportJob(ctx context.Context, username string, id primitive.ObjectID) (*ExportJob, error) {
+	var job ExportJob
+	err := exportCollection().FindOne(ctx, bson.M{"_id": id, "username": username}).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrExportNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ListExportJobs returns username's export jobs, newest first.
+func ListExportJobs(ctx context.Context, username string) ([]ExportJob, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cursor, err := exportCollection().Find(ctx, bson.M{"username": username}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	jobs := make([]ExportJob, 0)
+	if err = cursor.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// OpenExportArchive opens the ZIP of a completed export job.
+func OpenExportArchive(ctx context.Context, job *ExportJob) (io.ReadCloser, error) {
+	if job.Status != ExportCompleted {
+		return nil, ErrExportNotReady
+	}
+	return GetBlobStore().Get(ctx, exportArchiveKey(job.ID))
+}
+
+// DeleteUserExports removes username's export jobs and their files.
+func DeleteUserExports(ctx context.Context, username string) (int64, error) {
+	jobs, err := ListExportJobs(ctx, username)
+	if err != nil {
+		return 0, err
+	}
+	for i := range jobs {
+		if err := deleteExportFiles(ctx, &jobs[i]); err != nil {
+			return 0, err
+		}
+	}
+	result, err := exportCollection().DeleteMany(ctx, bson.M{"username": username})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func deleteExportFiles(ctx context.Context, job *ExportJob) error {
+	keys := []string{exportArchiveKey(job.ID)}
+	for part := range job.Parts {
+		keys = append(keys, exportPartKey(job.ID, part))
+	}
+	for _, key := range keys {
+		if err := GetBlobStore().Delete(ctx, key); err != nil && err != ErrBlobNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimExportJob takes the lease on a queued job, or on a running job whose
+// worker died, e.g. because the service was restarted.
+func claimExportJob(ctx context.Context) (*ExportJob, error) {
+	now := time.Now()
+	filter := bson.M{"$or": []bson.M{
+		{"status": ExportQueued, "runAfter": bson.M{"$lte": now}},
+		{"status": ExportRunning, "leaseUntil": bson.M{"$lt": now}},
+	}}
+	update := bson.M{
+		"$set": bson.M{"status": ExportRunning, "leaseUntil": now.Add(exportLease)},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "runAfter", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var job ExportJob
+	err := exportCollection().FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// runExportJob fetches the parts that are still missing, then writes the
+// ZIP once every part is there.
+func runExportJob(ctx context.Context, job *ExportJob) error {
+	pending, err := renamePending(ctx, job.Username)
+	if err != nil {
+		return err
+	}
+	if pending {
+		return retryExportLater(ctx, job, "waiting for a username change to propagate")
+	}
+
+	var lastErr error
+	for name, part := range job.Parts {
+		if part.Status == exportPartDone {
+			continue
+		}
+
+		data, err := fetchExportPart(ctx, job.Username, name)
+		if err == nil {
+			err = GetBlobStore().Put(ctx, exportPartKey(job.ID, name), bytes.NewReader(data))
+		}
+		now := time.Now()
+		if err != nil {
+			log.Printf("Failed to export %s for %s: %v", name, job.Username, err)
+			*part = ExportPart{Status: exportPartFailed, Error: err.Error()}
+			lastErr = err
+		} else {
+			*part = ExportPart{Status: exportPartDone, CompletedAt: &now}
+		}
+		if _, err := exportCollection().UpdateByID(ctx, job.ID, bson.M{"$set": bson.M{"parts." + name: part}}); err != nil {
+			return err
+		}
+	}
+	if lastErr != nil {
+		if job.Attempts >= exportMaxAttempts {
+			return failExport(ctx, job, lastErr)
+		}
+		return retryExportLater(ctx, job, "")
+	}
+
+	size, err := writeExportArchive(ctx, job)
+	if err != nil {
+		if job.Attempts >= exportMaxAttempts {
+			return failExport(ctx, job, err)
+		}
+		return err
+	}
+
+	now := time.Now()
+	_, err = exportCollection().UpdateByID(ctx, job.ID, bson.M{
+		"$set": bson.M{
+			"status":      ExportCompleted,
+			"size":        size,
+			"completedAt": now,
+			"expiresAt":   now.Add(exportTTL),
+		},
+		"$unset": bson.M{"leaseUntil": "", "error": ""},
+	})
+	if err != nil {
+		return err
+	}
+
+	user, err := FindUserByUsername(ctx, job.Username)
+	if err == nil && user.Email != "" {
+		body := fmt.Sprintf("Hi %s,\n\nYour data export is ready and can be downloaded until %s:\n\n%s",
+			user.Username, now.Add(exportTTL).Format(time.RFC1123), appBaseURL()+"/settings/exports/"+job.ID.Hex())
+		if err := GetMailSender().Send(user.Email, "Your data export is ready", body); err != nil {
+			log.Printf("Failed to send export mail to %s: %v", user.Username, err)
+		}
+	}
+	return nil
+}
+
+func retryExportLater(ctx context.Context, job *ExportJob, reason string) error {
+	if reason != "" {
+		log.Printf("Deferring export %s: %s", job.ID.Hex(), reason)
+	}
+	_, err := exportCollection().UpdateByID(ctx, job.ID, bson.M{
+		"$set":   bson.M{"status": ExportQueued, "runAfter": time.Now().Add(exportRetryInterval)},
+		"$unset": bson.M{"leaseUntil": ""},
+	})
+	return err
+}
+
+func failExport(ctx context.Context, job *ExportJob, cause error) error {
+	_, err := exportCollection().UpdateByID(ctx, job.ID, bson.M{
+		"$set":   bson.M{"status": ExportFailed, "error": cause.Error(), "expiresAt": time.Now().Add(exportTTL)},
+		"$unset": bson.M{"leaseUntil": ""},
+	})
+	return err
+}
+
+// fetchExportPart returns one source's data as a JSON object whose keys
+// become the file names in the archive.
+func fetchExportPart(ctx context.Context, username, part string) ([]byte, error) {
+	if part == "auth-service" {
+		return exportAuthData(ctx, username)
+	}
+	service, ok := findDownstreamService(part)
+	if !ok {
+		return []byte("{}"), nil
+	}
+	var data json.RawMessage
+	if err := callService(ctx, service, "/internal/users/export", map[string]string{"username": username}, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func exportAuthData(ctx context.Context, username string) ([]byte, error) {
+	user, err := FindUserByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := ListPATs(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := ListSessions(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	consents, err := ListConsents(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]interface{}{
+		"profile": map[string]interface{}{
+			"username":      user.Username,
+			"email":         user.Email,
+			"emailVerified": user.EmailVerified,
+			"roles":         UserRoles(user),
+			"createdAt":     user.CreatedAt,
+			"totpEnabled":   user.TOTPEnabled,
+			"profile":       NewPublicProfile(user),
+		},
+		"access_tokens": tokens,
+		"sessions":      sessions,
+		"app_consents":  consents,
+	})
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// writeExportArchive streams the ZIP into the blob store and returns its size.
+func writeExportArchive(ctx context.Context, job *ExportJob) (int64, error) {
+	pr, pw := io.Pipe()
+	counter := &countingWriter{}
+	go func() {
+		pw.CloseWithError(buildExportArchive(ctx, job, io.MultiWriter(pw, counter)))
+	}()
+	if err := GetBlobStore().Put(ctx, exportArchiveKey(job.ID), pr); err != nil {
+		pr.CloseWithError(err)
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+func buildExportArchive(ctx context.Context, job *ExportJob, w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	names := make([]string, 0, len(job.Parts))
+	for name := range job.Parts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		blob, err := GetBlobStore().Get(ctx, exportPartKey(job.ID, name))
+		if err != nil {
+			return err
+		}
+		var files map[string]json.RawMessage
+		err = json.NewDecoder(blob).Decode(&files)
+		blob.Close()
+		if err != nil {
+			return fmt.Errorf("%s part: %v", name, err)
+		}
+
+		for key, raw := range files {
+			var pretty bytes.Buffer
+			if err := json.Indent(&pretty, raw, "", "  "); err != nil {
+				return err
+			}
+			f, err := zw.Create(key + ".json")
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write(pretty.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		if raw, ok := files["posts"]; ok {
+			if err := writePostMarkdown(zw, raw); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := writeExportAvatar(ctx, zw, job.Username); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writePostMarkdown adds every post as posts/NNN-title.md with the post's
+// other fields as front matter.
+func writePostMarkdown(zw *zip.Writer, raw json.RawMessage) error {
+	var posts []map[string]interface{}
+	if err := json.Unmarshal(raw, &posts); err != nil {
+		return err
+	}
+
+	for i, post := range posts {
+		title, _ := post["title"].(string)
+		content, _ := post["content"].(string)
+
+		keys := make([]string, 0, len(post))
+		for key := range post {
+			if key != "content" {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		var b strings.Builder
+		b.WriteString("---\n")
+		for _, key := range keys {
+			value, err := json.Marshal(post[key])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&b, "%s: %s\n", key, value)
+		}
+		b.WriteString("---\n\n")
+		b.WriteString(content)
+		b.WriteString("\n")
+
+		f, err := zw.Create(fmt.Sprintf("posts/%03d-%s.md", i+1, fileSlug(title)))
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeExportAvatar(ctx context.Context, zw *zip.Writer, username string) error {
+	user, err := FindUserByUsername(ctx, username)
+	if err != nil || user.Profile.AvatarKey == "" {
+		return nil
+	}
+	blob, err := GetBlobStore().Get(ctx, user.Profile.AvatarKey)
+	if err == ErrBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	f, err := zw.Create("avatar.png")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, blob)
+	return err
+}
+
+var fileSlugReplacer = strings.NewReplacer(
+	"i̇", "i", "ç", "c", "ğ", "g", "ı", "i", "ö", "o", "ş", "s", "ü", "u",
+)
+
+// fileSlug turns a title into a short, safe file name.
+func fileSlug(title string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range fileSlugReplacer.Replace(strings.ToLower(title)) {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+		if b.Len() >= 60 {
+			break
+		}
+	}
+	slug := strings.Trim(b.String(), "-")
+	if slug == "" {
+		return "untitled"
+	}
+	return slug
+}
+
+// cleanupExpiredExports deletes finished exports that are past their expiry.
+func cleanupExpiredExports(ctx context.Context) error {
+	cursor, err := exportCollection().Find(ctx, bson.M{"expiresAt": bson.M{"$lt": time.Now()}})
+	if err != nil {
+		return err
+	}
+	var jobs []ExportJob
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return err
+	}
+	for i := range jobs {
+		if err := deleteExportFiles(ctx, &jobs[i]); err != nil {
+			return err
+		}
+		if _, err := exportCollection().DeleteOne(ctx, bson.M{"_id": jobs[i].ID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartExportWorker runs queued export jobs and picks up jobs that were
+// interrupted by a restart.
+func StartExportWorker() {
+	go func() {
+		for {
+			processExportJobs()
+			select {
+			case <-exportWake:
+			case <-time.After(exportCheckInterval):
+			}
+		}
+	}()
+}
+
+func processExportJobs() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	if err := cleanupExpiredExports(ctx); err != nil {
+		log.Printf("Failed to clean up exports: %v", err)
+	}
+	cancel()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), exportLease)
+		job, err := claimExportJob(ctx)
+		if err != nil || job == nil {
+			if err != nil {
+				log.Printf("Export worker failed: %v", err)
+			}
+			cancel()
+			return
+		}
+		if err := runExportJob(ctx, job); err != nil {
+			log.Printf("Export %s failed: %v", job.ID.Hex(), err)
+		}
+		cancel()
+	}
+}
+
+// exportFileName is the name offered to the browser for the download.
+func exportFileName(job *ExportJob) string {
+	return "takeout-" + fileSlug(job.Username) + "-" + job.CreatedAt.Format("20060102") + ".zip"
+}
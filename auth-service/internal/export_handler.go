@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ExportsHandler serves POST (start an export) and GET (list exports) on
+// /users/me/exports.
+func ExportsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	username := r.Header.Get("username")
+	switch r.Method {
+	case http.MethodPost:
+		job, err := CreateExportJob(ctx, username)
+		if err == ErrExportPending {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to start export", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/users/me/exports/"+job.ID.Hex())
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+	case http.MethodGet:
+		jobs, err := ListExportJobs(ctx, username)
+		if err != nil {
+			http.Error(w, "Failed to get exports", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jobs)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ExportHandler serves GET /users/me/exports/{id} (status) and
+// GET /users/me/exports/{id}/download (the ZIP file).
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/users/me/exports/")
+	idHex, action, _ := strings.Cut(rest, "/")
+	id, err := primitive.ObjectIDFromHex(idHex)
+	if err != nil || (action != "" && action != "download") {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	job, err := FindExportJob(ctx, r.Header.Get("username"), id)
+	if err == ErrExportNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get export", http.StatusInternalServerError)
+		return
+	}
+
+	if action == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+		return
+	}
+
+	// The download may take longer than the lookup.
+	archive, err := OpenExportArchive(r.Context(), job)
+	if err == ErrExportNotReady {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read export", http.StatusInternalServerError)
+		return
+	}
+	defer archive.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+exportFileName(job)+`"`)
+	if job.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(job.Size, 10))
+	}
+	io.Copy(w, archive)
+}
@@ -0,0 +1,631 @@
+package internal
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	externalLoginTTL     = 10 * time.Minute
+	externalLoginCodeTTL = 2 * time.Minute
+
+	// providerMetadataTTL is how long a provider's discovery document is
+	// cached; its keys are refetched at most every providerKeysMinAge when a
+	// token names an unknown kid.
+	providerMetadataTTL = time.Hour
+	providerKeysMinAge  = time.Minute
+)
+
+var (
+	ErrInvalidExternalState  = errors.New("invalid or expired sign-in attempt")
+	ErrInvalidExternalCode   = errors.New("invalid or expired login code")
+	ErrIdentityLinked        = errors.New("this account at the provider is already linked to another user")
+	ErrIdentityNotFound      = errors.New("identity not linked")
+	ErrExternalEmailTaken    = errors.New("an account with this email address already exists; sign in with your password and link the provider from your settings")
+	ErrLastSignInMethod      = errors.New("set a password before removing your last sign-in method")
+	errProviderMisconfigured = errors.New("provider returned an unexpected response")
+)
+
+var (
+	externalClient            = &http.Client{Timeout: 10 * time.Second}
+	externalProviderNameRegex = regexp.MustCompile(`^[a-z0-9-]+$`)
+)
+
+// ExternalProvider is an OpenID Connect provider users can sign in with.
+// Providers are read once from the JSON array in the file named by
+// OIDC_PROVIDERS_FILE or, failing that, from OIDC_PROVIDERS:
+//
+//	[{"name": "google", "display_name": "Google",
+//	  "issuer": "https://accounts.google.com",
+//	  "client_id": "...", "client_secret": "..."}]
+type ExternalProvider struct {
+	Name         string   `json:"name"`
+	DisplayName  string   `json:"display_name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+
+	mu            sync.Mutex
+	metadata      *providerMetadata
+	metadataAt    time.Time
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+// providerMetadata is the part of a provider's discovery document we use.
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// ExternalClaims is what we learn about the user from a provider's id_token.
+type ExternalClaims struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Name              string
+}
+
+var (
+	externalProvidersOnce sync.Once
+	externalProviders     []*ExternalProvider
+)
+
+// ExternalProviders returns the configured providers.
+func ExternalProviders() []*ExternalProvider {
+	externalProvidersOnce.Do(func() {
+		raw := []byte(os.Getenv("OIDC_PROVIDERS"))
+		if path := os.Getenv("OIDC_PROVIDERS_FILE"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				log.Printf("Failed to read OIDC_PROVIDERS_FILE: %v", err)
+				return
+			}
+			raw = data
+		}
+		if len(raw) == 0 {
+			return
+		}
+
+		var providers []*ExternalProvider
+		if err := json.Unmarshal(raw, &providers); err != nil {
+			log.Printf("Failed to parse external OIDC providers: %v", err)
+			return
+		}
+		for _, p := range providers {
+			if !externalProviderNameRegex.MatchString(p.Name) || p.Issuer == "" || p.ClientID == "" {
+				log.Printf("Ignoring external OIDC provider %q: name, issuer and client_id are required", p.Name)
+				continue
+			}
+			p.Issuer = strings.TrimRight(p.Issuer, "/")
+			if p.DisplayName == "" {
+				p.DisplayName = p.Name
+			}
+			if len(p.Scopes) == 0 {
+				p.Scopes = []string{ScopeOpenID, ScopeEmail, ScopeProfile}
+			}
+			externalProviders = append(externalProviders, p)
+		}
+	})
+	return externalProviders
+}
+
+func FindExternalProvider(name string) (*ExternalProvider, bool) {
+	for _, p := range ExternalProviders() {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// callbackURL is where the provider sends the browser back to.
+func (p *ExternalProvider) callbackURL() string {
+	return oidcIssuer() + "/login/external/" + p.Name + "/callback"
+}
+
+func getJSON(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := externalClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// discover returns the provider's discovery document, fetching it when the
+// cached copy is too old.
+func (p *ExternalProvider) discover(ctx context.Context) (*providerMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil && time.Since(p.metadataAt) < providerMetadataTTL {
+		return p.metadata, nil
+	}
+
+	var metadata providerMetadata
+	if err := getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &metadata); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(metadata.Issuer, "/") != p.Issuer || metadata.AuthorizationEndpoint == "" ||
+		metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errProviderMisconfigured
+	}
+	p.metadata = &metadata
+	p.metadataAt = time.Now()
+	return p.metadata, nil
+}
+
+// signingKey returns the provider's RSA key with the given kid, refetching
+// the provider's JWKS when the kid is new.
+func (p *ExternalProvider) signingKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < providerKeysMinAge {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set JWKSet
+	if err := getJSON(ctx, metadata.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// exchange redeems an authorization code at the provider and returns the
+// verified claims of the id_token that came with it.
+func (p *ExternalProvider) exchange(ctx context.Context, code, verifier, nonce string) (*ExternalClaims, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.callbackURL()},
+		"code_verifier": {verifier},
+		"client_id":     {p.ClientID},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := externalClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s token endpoint returned %s", p.Name, resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil || tokens.IDToken == "" {
+		return nil, errProviderMisconfigured
+	}
+	return p.verifyIDToken(ctx, metadata, tokens.IDToken, nonce)
+}
+
+func (p *ExternalProvider) verifyIDToken(ctx context.Context, metadata *providerMetadata, raw, nonce string) (*ExternalClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.signingKey(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithIssuer(metadata.Issuer),
+		jwt.WithAudience(p.ClientID),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("id_token has no expiry")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("id_token nonce does not match")
+	}
+
+	result := &ExternalClaims{}
+	result.Subject, _ = claims["sub"].(string)
+	result.Email, _ = claims["email"].(string)
+	result.PreferredUsername, _ = claims["preferred_username"].(string)
+	result.Name, _ = claims["name"].(string)
+	// Some providers send email_verified as a string.
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		result.EmailVerified = verified
+	case string:
+		result.EmailVerified, _ = strconv.ParseBool(verified)
+	}
+	if result.Subject == "" {
+		return nil, errors.New("id_token has no subject")
+	}
+	result.Email = NormalizeEmail(result.Email)
+	return result, nil
+}
+
+func externalLoginCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("external_logins")
+}
+
+// StartExternalLogin records a new sign-in attempt with p and returns the
+// provider URL to send the browser to. linkUsername is set when a signed-in
+// user links p to their account instead of signing in.
+func StartExternalLogin(ctx context.Context, p *ExternalProvider, linkUsername string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := GenerateRandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := GenerateRandomToken(48)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	_, err = externalLoginCollection().InsertOne(ctx, ExternalLogin{
+		StateHash:    HashToken(state),
+		Provider:     p.Name,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		LinkUsername: linkUsername,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(externalLoginTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.callbackURL()},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// ClaimExternalLogin returns the sign-in attempt for the state the provider
+// sent back. A state can be used once.
+func ClaimExternalLogin(ctx context.Context, p *ExternalProvider, state string) (*ExternalLogin, error) {
+	var login ExternalLogin
+	err := externalLoginCollection().FindOneAndUpdate(ctx,
+		bson.M{"stateHash": HashToken(state), "provider": p.Name, "expiresAt": bson.M{"$gt": time.Now()}},
+		bson.M{"$unset": bson.M{"stateHash": ""}},
+	).Decode(&login)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidExternalState
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &login, nil
+}
+
+// Exchange redeems the code the provider sent back for login and returns
+// the user's verified claims.
+func (p *ExternalProvider) Exchange(ctx context.Context, login *ExternalLogin, code string) (*ExternalClaims, error) {
+	return p.exchange(ctx, code, login.CodeVerifier, login.Nonce)
+}
+
+// IssueExternalLoginCode binds a finished sign-in to username and returns
+// the one-time code the frontend trades for tokens.
+func IssueExternalLoginCode(ctx context.Context, login *ExternalLogin, username string) (string, error) {
+	code, err := GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = externalLoginCollection().UpdateByID(ctx, login.ID, bson.M{"$set": bson.M{
+		"username":  username,
+		"codeHash":  HashToken(code),
+		"expiresAt": time.Now().Add(externalLoginCodeTTL),
+	}})
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// RedeemExternalLoginCode uses up a login code and returns its username.
+func RedeemExternalLoginCode(ctx context.Context, code string) (string, error) {
+	var login ExternalLogin
+	err := externalLoginCollection().FindOneAndDelete(ctx, bson.M{
+		"codeHash":     HashToken(code),
+		"linkUsername": bson.M{"$exists": false},
+		"expiresAt":    bson.M{"$gt": time.Now()},
+	}).Decode(&login)
+	if err == mongo.ErrNoDocuments {
+		return "", ErrInvalidExternalCode
+	}
+	if err != nil {
+		return "", err
+	}
+	return login.Username, nil
+}
+
+// IssueExternalLinkCode keeps the identity a link attempt verified and
+// returns the one-time code the frontend confirms it with. Linking happens
+// only on confirmation by the user who started the attempt, so a provider
+// URL handed to someone else cannot link their identity to that user.
+func IssueExternalLinkCode(ctx context.Context, login *ExternalLogin, claims *ExternalClaims) (string, error) {
+	code, err := GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = externalLoginCollection().UpdateByID(ctx, login.ID, bson.M{"$set": bson.M{
+		"claims":    claims,
+		"codeHash":  HashToken(code),
+		"expiresAt": time.Now().Add(externalLoginCodeTTL),
+	}})
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// RedeemExternalLinkCode uses up a link code for provider and returns the
+// identity it verified. Only username, who started the link, can redeem it.
+func RedeemExternalLinkCode(ctx context.Context, code, username, provider string) (*ExternalClaims, error) {
+	var login ExternalLogin
+	err := externalLoginCollection().FindOneAndDelete(ctx, bson.M{
+		"codeHash":     HashToken(code),
+		"linkUsername": username,
+		"provider":     provider,
+		"claims":       bson.M{"$exists": true},
+		"expiresAt":    bson.M{"$gt": time.Now()},
+	}).Decode(&login)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidExternalCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	return login.Claims, nil
+}
+
+func identityFilter(provider, subject string) bson.M {
+	return bson.M{"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}}}
+}
+
+// ResolveExternalLogin finds or creates the account for a user signing in
+// through provider. Accounts are found by the linked identity first, then by
+// email address. Linking by email needs the address verified both by the
+// provider and by us, otherwise whoever registered the address first could
+// take over the account. created reports whether a new account was made.
+func ResolveExternalLogin(ctx context.Context, provider string, claims *ExternalClaims) (*User, bool, error) {
+	user, err := findUser(ctx, identityFilter(provider, claims.Subject))
+	if err != ErrUserNotFound {
+		return user, false, err
+	}
+
+	if claims.Email != "" {
+		user, err := FindUserByEmail(ctx, claims.Email)
+		if err != nil && err != ErrUserNotFound {
+			return nil, false, err
+		}
+		if user != nil {
+			if !claims.EmailVerified || !user.EmailVerified {
+				return nil, false, ErrExternalEmailTaken
+			}
+			if err := LinkExternalIdentity(ctx, user.Username, provider, claims); err != nil {
+				return nil, false, err
+			}
+			user, err = FindUserByUsername(ctx, user.Username)
+			return user, false, err
+		}
+	}
+
+	user = &User{
+		Email:         claims.Email,
+		EmailVerified: claims.Email != "" && claims.EmailVerified,
+		Roles:         DefaultRoles,
+		CreatedAt:     time.Now(),
+		Identities: []ExternalIdentity{{
+			Provider: provider,
+			Subject:  claims.Subject,
+			Email:    claims.Email,
+			LinkedAt: time.Now(),
+		}},
+	}
+	for _, candidate := range usernameCandidates(claims) {
+		user.Username = candidate
+		err := CreateUser(ctx, user)
+		if err == nil {
+			return user, true, nil
+		}
+		if err == ErrEmailTaken {
+			return nil, false, ErrExternalEmailTaken
+		}
+		if err != ErrUsernameTaken {
+			return nil, false, err
+		}
+	}
+	return nil, false, ErrUsernameTaken
+}
+
+// usernameCandidates suggests usernames for a new account from the
+// provider's claims, in order of preference, ending with a random one.
+func usernameCandidates(claims *ExternalClaims) []string {
+	var bases []string
+	local, _, _ := strings.Cut(claims.Email, "@")
+	for _, source := range []string{claims.PreferredUsername, local, claims.Name} {
+		var b strings.Builder
+		for _, r := range fileSlugReplacer.Replace(strings.ToLower(source)) {
+			switch {
+			case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '.', r == '-':
+				b.WriteRune(r)
+			case r == ' ':
+				b.WriteRune('_')
+			}
+		}
+		base := strings.TrimLeft(b.String(), "_.-")
+		if len(base) > usernameMaxLength-2 {
+			base = base[:usernameMaxLength-2]
+		}
+		if base != "" {
+			bases = append(bases, base)
+		}
+	}
+
+	var candidates []string
+	for _, base := range uniqueStrings(bases) {
+		for i := 1; i <= 5; i++ {
+			name := base
+			if i > 1 {
+				name = base + strconv.Itoa(i)
+			}
+			if len(ValidateUsername(name)) == 0 {
+				candidates = append(candidates, name)
+			}
+		}
+	}
+	if suffix, err := GenerateRandomToken(6); err == nil {
+		name := "user" + strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(suffix))
+		if len(ValidateUsername(name)) == 0 {
+			candidates = append(candidates, name)
+		}
+	}
+	return candidates
+}
+
+// LinkExternalIdentity lets username sign in through provider from now on,
+// replacing an earlier link to the same provider.
+func LinkExternalIdentity(ctx context.Context, username, provider string, claims *ExternalClaims) error {
+	owner, err := findUser(ctx, identityFilter(provider, claims.Subject))
+	if err == nil {
+		if owner.Username == username {
+			return nil
+		}
+		return ErrIdentityLinked
+	}
+	if err != ErrUserNotFound {
+		return err
+	}
+
+	if _, err := userCollection().UpdateOne(ctx,
+		bson.M{"username": username},
+		bson.M{"$pull": bson.M{"identities": bson.M{"provider": provider}}},
+	); err != nil {
+		return err
+	}
+	result, err := userCollection().UpdateOne(ctx,
+		bson.M{"username": username},
+		bson.M{"$push": bson.M{"identities": ExternalIdentity{
+			Provider: provider,
+			Subject:  claims.Subject,
+			Email:    claims.Email,
+			LinkedAt: time.Now(),
+		}}},
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrIdentityLinked
+	}
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// UnlinkExternalIdentity removes user's link to provider unless it is the
+// only way left to sign in.
+func UnlinkExternalIdentity(ctx context.Context, user *User, provider string) error {
+	linked := false
+	for _, identity := range user.Identities {
+		linked = linked || identity.Provider == provider
+	}
+	if !linked {
+		return ErrIdentityNotFound
+	}
+	if user.Password == "" && len(user.Identities) == 1 {
+		return ErrLastSignInMethod
+	}
+	_, err := userCollection().UpdateOne(ctx,
+		bson.M{"username": user.Username},
+		bson.M{"$pull": bson.M{"identities": bson.M{"provider": provider}}},
+	)
+	return err
+}
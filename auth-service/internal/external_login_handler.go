@@ -0,0 +1,322 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Frontend pages the browser lands on after visiting a provider.
+func externalLoginPage() string    { return appBaseURL() + "/login/external" }
+func identitySettingsPage() string { return appBaseURL() + "/settings/identities" }
+
+func redirectWith(w http.ResponseWriter, r *http.Request, page string, params url.Values) {
+	http.Redirect(w, r, page+"?"+params.Encode(), http.StatusFound)
+}
+
+// ExternalProvidersHandler lists the providers users can sign in with at
+// GET /login/providers.
+func ExternalProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	providers := make([]map[string]string, 0)
+	for _, p := range ExternalProviders() {
+		providers = append(providers, map[string]string{"name": p.Name, "display_name": p.DisplayName})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(providers)
+}
+
+// ExternalLoginHandler sends the browser to a provider at GET
+// /login/external/{provider} and takes it back at
+// /login/external/{provider}/callback. A successful sign-in ends on the
+// frontend's /login/external page with a one-time code for
+// /login/external/exchange; linking ends on /settings/identities with a
+// one-time code for POST /users/me/identities/{provider}/confirm.
+func ExternalLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/login/external/"), "/")
+	provider, ok := FindExternalProvider(name)
+	if !ok || (action != "" && action != "callback") {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	if action == "" {
+		authorizeURL, err := StartExternalLogin(ctx, provider, "")
+		if err != nil {
+			log.Printf("Failed to start sign-in with %s: %v", provider.Name, err)
+			http.Error(w, "Provider unavailable", http.StatusBadGateway)
+			return
+		}
+		http.Redirect(w, r, authorizeURL, http.StatusFound)
+		return
+	}
+
+	query := r.URL.Query()
+	login, err := ClaimExternalLogin(ctx, provider, query.Get("state"))
+	if err != nil {
+		if err != ErrInvalidExternalState {
+			log.Printf("Failed to look up sign-in with %s: %v", provider.Name, err)
+		}
+		redirectWith(w, r, externalLoginPage(), url.Values{"error": {"invalid_state"}})
+		return
+	}
+
+	page := externalLoginPage()
+	if login.LinkUsername != "" {
+		page = identitySettingsPage()
+	}
+	if providerErr := query.Get("error"); providerErr != "" {
+		redirectWith(w, r, page, url.Values{"error": {providerErr}})
+		return
+	}
+
+	claims, err := provider.Exchange(ctx, login, query.Get("code"))
+	if err != nil {
+		log.Printf("Sign-in with %s failed: %v", provider.Name, err)
+		redirectWith(w, r, page, url.Values{"error": {"provider_error"}})
+		return
+	}
+
+	if login.LinkUsername != "" {
+		code, err := IssueExternalLinkCode(ctx, login, claims)
+		if err != nil {
+			log.Printf("Failed to keep link of %s for %s: %v", provider.Name, login.LinkUsername, err)
+			redirectWith(w, r, page, url.Values{"error": {"server_error"}})
+			return
+		}
+		redirectWith(w, r, page, url.Values{"provider": {provider.Name}, "link_code": {code}})
+		return
+	}
+
+	user, created, err := ResolveExternalLogin(ctx, provider.Name, claims)
+	if err == ErrExternalEmailTaken {
+		redirectWith(w, r, page, url.Values{"error": {"email_taken"}})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to resolve sign-in with %s: %v", provider.Name, err)
+		redirectWith(w, r, page, url.Values{"error": {"server_error"}})
+		return
+	}
+	if err := CheckAccountUsable(user); err != nil {
+		RecordAuthEvent(r, EventLoginRefused, user.Username, err.Error())
+		redirectWith(w, r, page, url.Values{"error": {"account_unavailable"}})
+		return
+	}
+
+	code, err := IssueExternalLoginCode(ctx, login, user.Username)
+	if err != nil {
+		redirectWith(w, r, page, url.Values{"error": {"server_error"}})
+		return
+	}
+	outcome := "via " + provider.Name
+	if created {
+		outcome += ", account created"
+	}
+	RecordAuthEvent(r, EventExternalLogin, user.Username, outcome)
+	redirectWith(w, r, page, url.Values{"code": {code}})
+}
+
+// ExternalLoginExchangeHandler trades the one-time code from an external
+// sign-in for a token pair at POST /login/external/exchange. Accounts with
+// TOTP get an "mfa pending" token instead, as from /login.
+func ExternalLoginExchangeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Code == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	username, err := RedeemExternalLoginCode(ctx, request.Code)
+	if err == ErrInvalidExternalCode {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := FindUserByUsername(ctx, username)
+	if err != nil {
+		http.Error(w, ErrInvalidExternalCode.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := CheckAccountUsable(user); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if user.TOTPEnabled {
+		mfaToken, err := CreateMFAChallenge(ctx, user.Username)
+		if err != nil {
+			http.Error(w, "MFA challenge error", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"expires_in":   int64(mfaChallengeTTL.Seconds()),
+		})
+		return
+	}
+
+	tokens, err := IssueTokenPair(ctx, r, user, "")
+	if err != nil {
+		http.Error(w, "JWT error", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// IdentitiesHandler lists the caller's linked providers at GET
+// /users/me/identities.
+func IdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := FindUserByUsername(ctx, r.Header.Get("username"))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	identities := user.Identities
+	if identities == nil {
+		identities = []ExternalIdentity{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"identities":   identities,
+		"has_password": user.Password != "",
+	})
+}
+
+// IdentityHandler links (POST) or unlinks (DELETE) a provider at
+// /users/me/identities/{provider}. Linking answers with the provider URL to
+// send the browser to; the link is made when the frontend brings the code
+// from the callback back to POST /users/me/identities/{provider}/confirm.
+func IdentityHandler(w http.ResponseWriter, r *http.Request) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/users/me/identities/"), "/")
+	provider, ok := FindExternalProvider(name)
+	if !ok || (action != "" && action != "confirm") {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	username := r.Header.Get("username")
+	if action == "confirm" {
+		confirmIdentityLink(ctx, w, r, provider, username)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		authorizeURL, err := StartExternalLogin(ctx, provider, username)
+		if err != nil {
+			log.Printf("Failed to start linking %s for %s: %v", provider.Name, username, err)
+			http.Error(w, "Provider unavailable", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"authorize_url": authorizeURL})
+	case http.MethodDelete:
+		user, err := FindUserByUsername(ctx, username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		err = UnlinkExternalIdentity(ctx, user, provider.Name)
+		switch err {
+		case nil:
+		case ErrIdentityNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case ErrLastSignInMethod:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			http.Error(w, "Failed to unlink provider", http.StatusInternalServerError)
+			return
+		}
+		RecordAuthEvent(r, EventIdentityUnlinked, username, provider.Name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// confirmIdentityLink links the identity from a link code to username, who
+// must be the user that started the link.
+func confirmIdentityLink(ctx context.Context, w http.ResponseWriter, r *http.Request, provider *ExternalProvider, username string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Code == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := RedeemExternalLinkCode(ctx, request.Code, username, provider.Name)
+	if err == ErrInvalidExternalCode {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to link provider", http.StatusInternalServerError)
+		return
+	}
+
+	err = LinkExternalIdentity(ctx, username, provider.Name, claims)
+	if err == ErrIdentityLinked {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to link %s to %s: %v", provider.Name, username, err)
+		http.Error(w, "Failed to link provider", http.StatusInternalServerError)
+		return
+	}
+	RecordAuthEvent(r, EventIdentityLinked, username, provider.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"linked": provider.Name})
+}
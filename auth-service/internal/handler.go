@@ -4,8 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/mail"
+	"strconv"
 	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 
@@ -19,74 +25,489 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user User
-	err := json.NewDecoder(r.Body).Decode(&user)
-	if err != nil || user.Username == "" || user.Password == "" {
+	var request struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}
+	err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&request)
+	if err != nil {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
 
-	hashedPassword, err := HashPassword(user.Password)
-	if err != nil {
-		http.Error(w, "Password hashing failed", http.StatusInternalServerError)
+	email := NormalizeEmail(request.Email)
+	violations := append(ValidateUsername(request.Username), ValidatePassword(request.Password, request.Username)...)
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		violations = append(violations, PolicyViolation{Field: "email", Rule: "format", Message: "is not a valid email address"})
+	}
+	if len(violations) > 0 {
+		writeViolations(w, violations)
 		return
 	}
-	user.Password = hashedPassword
 
-	collection := Client.Database("authdb").Collection("users")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	count, _ := collection.CountDocuments(ctx, map[string]interface{}{"username": user.Username})
-	if count > 0 {
-		http.Error(w, "Username already exists", http.StatusConflict)
+	allowed, err := AllowRegistration(ctx, ClientIP(r))
+	if err != nil {
+		http.Error(w, "Registration check failed", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		RecordAuthEvent(r, EventRegisterThrottled, request.Username, "rejected")
+		tooManyAttempts(w, registerRateWindow)
 		return
 	}
 
-	_, err = collection.InsertOne(ctx, user)
+	hashedPassword, err := HashPassword(request.Password)
+	if err != nil {
+		http.Error(w, "Password hashing failed", http.StatusInternalServerError)
+		return
+	}
+
+	user := User{
+		Username:  request.Username,
+		Password:  hashedPassword,
+		Email:     email,
+		Roles:     DefaultRoles,
+		CreatedAt: time.Now(),
+	}
+
+	err = CreateUser(ctx, &user)
+	if err == ErrUsernameTaken || err == ErrEmailTaken {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "DB insert error", http.StatusInternalServerError)
 		return
 	}
 
+	if err := SendVerificationEmail(ctx, &user); err != nil {
+		log.Printf("Failed to send verification mail to %s: %v", user.Username, err)
+	}
+	RecordAuthEvent(r, EventRegistered, user.Username, "success")
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"message": "User registered successfully"})
 }
 
+// tooManyAttempts answers a throttled request with 429 and Retry-After.
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	http.Error(w, "Too many attempts, try again later", http.StatusTooManyRequests)
+}
+
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var reqUser User
-	err := json.NewDecoder(r.Body).Decode(&reqUser)
-	if err != nil || reqUser.Username == "" || reqUser.Password == "" {
+	var request struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Username == "" || request.Password == "" {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
 
-	collection := Client.Database("authdb").Collection("users")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var storedUser User
-	err = collection.FindOne(ctx, map[string]interface{}{"username": reqUser.Username}).Decode(&storedUser)
+	ip := ClientIP(r)
+	wait, err := LoginLockedFor(ctx, request.Username, ip)
 	if err != nil {
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		http.Error(w, "Login check failed", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		RecordAuthEvent(r, EventLoginFailed, request.Username, "locked out")
+		tooManyAttempts(w, wait)
 		return
 	}
 
-	if !CheckPasswordHash(reqUser.Password, storedUser.Password) {
+	storedUser, err := FindUserByUsername(ctx, request.Username)
+	if err != nil || !CheckPasswordHash(request.Password, storedUser.Password) {
+		reason := "wrong password"
+		if err != nil {
+			reason = "unknown user"
+		}
+		RecordAuthEvent(r, EventLoginFailed, request.Username, reason)
+		lockout, err := RecordLoginFailure(ctx, request.Username, ip)
+		if err != nil {
+			log.Printf("Failed to record login failure for %s: %v", request.Username, err)
+		}
+		if lockout > 0 {
+			RecordAuthEvent(r, EventLoginLockedOut, request.Username, "locked for "+lockout.String())
+		}
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
-	token, err := GenerateJWT(storedUser.Username)
+	if err := CheckAccountUsable(storedUser); err != nil {
+		RecordAuthEvent(r, EventLoginRefused, storedUser.Username, err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Upgrade bcrypt hashes and argon2id hashes with old parameters while we
+	// still have the plaintext password.
+	if PasswordNeedsRehash(storedUser.Password) {
+		if hashed, err := HashPassword(request.Password); err == nil {
+			if err := UpdateUser(ctx, storedUser.Username, bson.M{"password": hashed}); err != nil {
+				log.Printf("Failed to rehash password for %s: %v", storedUser.Username, err)
+			}
+		}
+	}
+
+	if storedUser.TOTPEnabled {
+		mfaToken, err := CreateMFAChallenge(ctx, storedUser.Username)
+		if err != nil {
+			http.Error(w, "MFA challenge error", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"expires_in":   int64(mfaChallengeTTL.Seconds()),
+		})
+		return
+	}
+
+	// With a second factor the failures are only forgotten once it is
+	// passed too, see LoginMFAHandler.
+	if err := ResetLoginFailures(ctx, storedUser.Username); err != nil {
+		log.Printf("Failed to reset login failures for %s: %v", storedUser.Username, err)
+	}
+
+	tokens, err := IssueTokenPair(ctx, r, storedUser, "")
+	if err != nil {
+		http.Error(w, "JWT error", http.StatusInternalServerError)
+		return
+	}
+	RecordAuthEvent(r, EventLoginSucceeded, storedUser.Username, "password")
+
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.RefreshToken == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stored, err := RotateRefreshToken(ctx, request.RefreshToken)
+	if err == ErrRefreshTokenReused {
+		RecordAuthEvent(r, EventRefreshReused, stored.Username, "revoked session "+stored.FamilyID)
+	}
+	if err != nil {
+		switch err {
+		case ErrInvalidRefreshToken, ErrRefreshTokenExpired, ErrRefreshTokenReused:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		default:
+			http.Error(w, "Token refresh failed", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	user, err := FindUserByUsername(ctx, stored.Username)
+	if err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err := CheckAccountUsable(user); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	tokens, err := IssueTokenPair(ctx, r, user, stored.FamilyID)
 	if err != nil {
 		http.Error(w, "JWT error", http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"token": token})
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokenStr, ok := BearerToken(r)
+	if !ok {
+		http.Error(w, "Invalid authorization header", http.StatusUnauthorized)
+		return
+	}
+	claims, err := ParseJWT(tokenStr)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	// The body is optional; when a refresh token is sent its family is revoked
+	// too, which matters for tokens issued before sessions had IDs.
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	jti, _ := claims["jti"].(string)
+	exp, err := claims.GetExpirationTime()
+	if jti != "" && err == nil && exp != nil {
+		if err := Revoke(ctx, revocationKindToken, jti, exp.Time); err != nil {
+			http.Error(w, "Logout failed", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Tokens carrying a session ID end their whole session.
+	if sid, _ := claims["sid"].(string); sid != "" {
+		if err := RevokeTokenFamily(ctx, sid); err != nil {
+			http.Error(w, "Logout failed", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if request.RefreshToken != "" {
+		if err := RevokeRefreshToken(ctx, request.RefreshToken); err != nil {
+			http.Error(w, "Logout failed", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+}
+
+// RevocationsHandler serves the deny-list that the other services poll. It
+// names users, so only the services may read it, see RequireServiceKey.
+// The optional "since" query parameter (RFC 3339) limits the response to
+// revocations recorded from that time on.
+func RevocationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	revocations, err := ListRevocations(ctx, since)
+	if err != nil {
+		http.Error(w, "Failed to get revocations", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"revocations": revocations,
+		"now":         now,
+	})
+}
+
+// ForgotPasswordHandler mails a reset link to the account's email address.
+// It answers the same way whether or not the account exists.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || (request.Username == "" && request.Email == "") {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user *User
+	var err error
+	if request.Username != "" {
+		user, err = FindUserByUsername(ctx, request.Username)
+	} else {
+		user, err = FindUserByEmail(ctx, request.Email)
+	}
+
+	if err == nil && user.Email != "" {
+		token, err := CreatePasswordReset(ctx, user.Username)
+		if err != nil {
+			http.Error(w, "Password reset failed", http.StatusInternalServerError)
+			return
+		}
+
+		mailPasswordReset(user, token, "If you did not ask for this, you can ignore this email.")
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "If the account exists, a reset link has been sent"})
+}
+
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Token == "" || request.Password == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Check the new password before the token is used up, so a rejected
+	// password can be corrected with the same link.
+	username, err := PasswordResetUser(ctx, request.Token)
+	if err == nil {
+		if violations := ValidatePassword(request.Password, username); len(violations) > 0 {
+			writeViolations(w, violations)
+			return
+		}
+		username, err = ConsumePasswordReset(ctx, request.Token)
+	}
+	if err == ErrInvalidResetToken {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Password reset failed", http.StatusInternalServerError)
+		return
+	}
+
+	hashedPassword, err := HashPassword(request.Password)
+	if err != nil {
+		http.Error(w, "Password hashing failed", http.StatusInternalServerError)
+		return
+	}
+
+	if err := UpdateUser(ctx, username, bson.M{"password": hashedPassword, "passwordResetRequired": false}); err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := RevokeUserSessions(ctx, username); err != nil {
+		log.Printf("Failed to revoke sessions for %s after password reset: %v", username, err)
+	}
+	RecordAuthEvent(r, EventPasswordReset, username, "success")
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password has been reset"})
+}
+
+// VerifyEmailHandler confirms an email address from the link sent by mail.
+// The token is accepted either as a "token" query parameter or JSON body.
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if r.Method == http.MethodPost && token == "" {
+		var request struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		token = request.Token
+	} else if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Only GET or POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if token == "" {
+		http.Error(w, "Token parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := VerifyEmail(ctx, token); err != nil {
+		if err == ErrInvalidVerificationToken {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Email verification failed", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email verified, refresh your token to pick up the change"})
+}
+
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := FindUserByUsername(ctx, r.Header.Get("username"))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.EmailVerified {
+		http.Error(w, "Email already verified", http.StatusConflict)
+		return
+	}
+	if user.Email == "" {
+		http.Error(w, "No email address on file", http.StatusBadRequest)
+		return
+	}
+
+	if err := SendVerificationEmail(ctx, user); err != nil {
+		log.Printf("Failed to send verification mail to %s: %v", user.Username, err)
+		http.Error(w, "Failed to send verification email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Verification email sent"})
+}
+
+// JWKSHandler publishes the public keys used to verify access tokens.
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(signingKeys.JWKS())
 }
@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// keyRotationInterval is how long a key signs new tokens before it is
+	// replaced. keyGracePeriod is how long a replaced key is still published
+	// for verification; it never drops below the access token lifetime.
+	keyRotationInterval = durationFromEnv("KEY_ROTATION_INTERVAL", 30*24*time.Hour)
+	keyGracePeriod      = durationFromEnv("KEY_GRACE_PERIOD", 24*time.Hour)
+	keyCheckInterval    = durationFromEnv("KEY_CHECK_INTERVAL", time.Minute)
+)
+
+var ErrNoSigningKey = errors.New("no signing key available")
+
+// keyRing caches the signing keys stored in authdb. Every replica reloads it
+// periodically, so a key created by one replica is picked up by the others.
+type keyRing struct {
+	mu   sync.RWMutex
+	keys []loadedKey // newest first
+}
+
+type loadedKey struct {
+	SigningKey
+	private *rsa.PrivateKey
+}
+
+var signingKeys = &keyRing{}
+
+func signingKeyCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("signing_keys")
+}
+
+// InitSigningKeys loads the keys, creates the first one if there is none and
+// starts the background rotation check.
+func InitSigningKeys() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := rotateSigningKeyIfDue(ctx); err != nil {
+		return err
+	}
+	if err := signingKeys.reload(ctx); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(keyCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := rotateSigningKeyIfDue(ctx); err != nil {
+				log.Printf("Signing key rotation failed: %v", err)
+			}
+			if err := signingKeys.reload(ctx); err != nil {
+				log.Printf("Signing key reload failed: %v", err)
+			}
+			cancel()
+		}
+	}()
+	return nil
+}
+
+// rotateSigningKeyIfDue creates a new key when there is none or the current
+// one is older than keyRotationInterval. Retiring the old key is a
+// conditional update, so only one replica performs a given rotation.
+func rotateSigningKeyIfDue(ctx context.Context) error {
+	collection := signingKeyCollection()
+
+	var current SigningKey
+	err := collection.FindOne(ctx,
+		bson.M{"retiredAt": nil},
+		options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: -1}}),
+	).Decode(&current)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	if err == nil {
+		if time.Since(current.CreatedAt) < keyRotationInterval {
+			return nil
+		}
+
+		grace := keyGracePeriod
+		if grace < accessTokenTTL {
+			grace = accessTokenTTL
+		}
+		now := time.Now()
+		result, err := collection.UpdateOne(ctx,
+			bson.M{"kid": current.Kid, "retiredAt": nil},
+			bson.M{"$set": bson.M{"retiredAt": now, "verifyUntil": now.Add(grace)}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			// Another replica is rotating this key.
+			return nil
+		}
+	}
+
+	key, err := newSigningKey()
+	if err != nil {
+		return err
+	}
+	if _, err := collection.InsertOne(ctx, key); err != nil {
+		return err
+	}
+	log.Printf("Created signing key %s", key.Kid)
+	return nil
+}
+
+func newSigningKey() (*SigningKey, error) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := GenerateRandomToken(12)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{
+		Kid:        kid,
+		Algorithm:  "RS256",
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		CreatedAt:  time.Now(),
+	}, nil
+}
+
+func (k *keyRing) reload(ctx context.Context) error {
+	cursor, err := signingKeyCollection().Find(ctx, bson.M{
+		"$or": []bson.M{
+			{"verifyUntil": nil},
+			{"verifyUntil": bson.M{"$gt": time.Now()}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var stored []SigningKey
+	if err := cursor.All(ctx, &stored); err != nil {
+		return err
+	}
+
+	keys := make([]loadedKey, 0, len(stored))
+	for _, sk := range stored {
+		block, _ := pem.Decode([]byte(sk.PrivateKey))
+		if block == nil {
+			return fmt.Errorf("signing key %s: invalid PEM", sk.Kid)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("signing key %s: %v", sk.Kid, err)
+		}
+		private, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return fmt.Errorf("signing key %s: not an RSA key", sk.Kid)
+		}
+		keys = append(keys, loadedKey{SigningKey: sk, private: private})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// current returns the newest key, which signs all new tokens.
+func (k *keyRing) current() (*loadedKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return nil, ErrNoSigningKey
+	}
+	key := k.keys[0]
+	return &key, nil
+}
+
+// publicKey returns the verification key for kid if it is still published.
+func (k *keyRing) publicKey(kid string) (*rsa.PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := time.Now()
+	for _, key := range k.keys {
+		if key.Kid == kid && (key.VerifyUntil == nil || now.Before(*key.VerifyUntil)) {
+			return &key.private.PublicKey, true
+		}
+	}
+	return nil, false
+}
+
+// JWKS returns the public halves of every key still valid for verification.
+func (k *keyRing) JWKS() JWKSet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := time.Now()
+	set := JWKSet{Keys: make([]JWK, 0, len(k.keys))}
+	for _, key := range k.keys {
+		if key.VerifyUntil != nil && now.After(*key.VerifyUntil) {
+			continue
+		}
+		pub := key.private.PublicKey
+		set.Keys = append(set.Keys, JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: key.Algorithm,
+			Kid: key.Kid,
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+	return set
+}
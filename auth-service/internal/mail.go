@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MailSender delivers transactional email such as password reset links.
+type MailSender interface {
+	Send(to, subject, body string) error
+}
+
+// LogMailSender appends every message to a local file instead of sending it.
+// It is meant for local development.
+type LogMailSender struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (s *LogMailSender) Send(to, subject, body string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().Format(time.RFC1123Z), to, subject, body)
+	return err
+}
+
+// SMTPMailSender sends mail through an SMTP relay using PLAIN auth.
+type SMTPMailSender struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (s *SMTPMailSender) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := strings.Split(s.Addr, ":")[0]
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		s.From, to, subject, body)
+	return smtp.SendMail(s.Addr, auth, s.From, []string{to}, []byte(msg))
+}
+
+var (
+	Mailer     MailSender
+	mailerOnce sync.Once
+)
+
+// GetMailSender returns the configured sender. MAIL_SENDER=smtp uses the
+// SMTP_* variables; anything else logs to MAIL_LOG_FILE (default mail.log).
+func GetMailSender() MailSender {
+	mailerOnce.Do(func() {
+		if Mailer != nil {
+			return
+		}
+		if os.Getenv("MAIL_SENDER") == "smtp" {
+			Mailer = &SMTPMailSender{
+				Addr:     os.Getenv("SMTP_ADDR"),
+				From:     os.Getenv("SMTP_FROM"),
+				Username: os.Getenv("SMTP_USERNAME"),
+				Password: os.Getenv("SMTP_PASSWORD"),
+			}
+			return
+		}
+		path := os.Getenv("MAIL_LOG_FILE")
+		if path == "" {
+			path = "mail.log"
+		}
+		log.Printf("Using log mail sender, writing to %s", path)
+		Mailer = &LogMailSender{Path: path}
+	})
+	return Mailer
+}
+
+// appBaseURL is the public URL of the blog frontend used to build links in
+// outgoing mail.
+func appBaseURL() string {
+	if url := os.Getenv("APP_BASE_URL"); url != "" {
+		return strings.TrimRight(url, "/")
+	}
+	return "http://localhost:3000"
+}
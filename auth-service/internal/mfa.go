@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	mfaChallengeTTL   = 5 * time.Minute
+	mfaMaxAttempts    = 5
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrInvalidMFAChallenge = errors.New("invalid or expired mfa token")
+	ErrInvalidMFACode      = errors.New("invalid verification code")
+)
+
+func mfaChallengeCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("mfa_challenges")
+}
+
+// CreateMFAChallenge stores a short-lived challenge for a user who passed the
+// password check and returns the opaque "mfa pending" token for it.
+func CreateMFAChallenge(ctx context.Context, username string) (string, error) {
+	token, err := GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	_, err = mfaChallengeCollection().InsertOne(ctx, MFAChallenge{
+		TokenHash: HashToken(token),
+		Username:  username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(mfaChallengeTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ClaimMFAAttempt uses up one of the attempts of the live challenge for
+// token and returns the challenge. The attempt is taken before the code is
+// checked and in the same update as the limit check, so concurrent requests
+// cannot get more than mfaMaxAttempts codes checked between them.
+func ClaimMFAAttempt(ctx context.Context, token string) (*MFAChallenge, error) {
+	var challenge MFAChallenge
+	err := mfaChallengeCollection().FindOneAndUpdate(ctx,
+		bson.M{
+			"tokenHash": HashToken(token),
+			"expiresAt": bson.M{"$gt": time.Now()},
+			"attempts":  bson.M{"$lt": mfaMaxAttempts},
+		},
+		bson.M{"$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&challenge)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// CompleteMFAChallenge deletes the challenge. It returns ErrInvalidMFAChallenge
+// if another request already completed it.
+func CompleteMFAChallenge(ctx context.Context, challenge *MFAChallenge) error {
+	result, err := mfaChallengeCollection().DeleteOne(ctx, bson.M{"tokenHash": challenge.TokenHash})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrInvalidMFAChallenge
+	}
+	return nil
+}
+
+// VerifySecondFactor accepts either a current TOTP code or one of the user's
+// unused recovery codes. TOTP time steps and recovery codes are single-use.
+func VerifySecondFactor(ctx context.Context, user *User, code string) error {
+	code = strings.TrimSpace(code)
+	if !user.TOTPEnabled || user.TOTPSecret == "" {
+		return ErrInvalidMFACode
+	}
+
+	if step, ok := ValidateTOTP(user.TOTPSecret, code, time.Now()); ok {
+		result, err := userCollection().UpdateOne(ctx,
+			bson.M{
+				"username": user.Username,
+				"$or": []bson.M{
+					{"totpLastStep": bson.M{"$exists": false}},
+					{"totpLastStep": bson.M{"$lt": step}},
+				},
+			},
+			bson.M{"$set": bson.M{"totpLastStep": step}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	result, err := userCollection().UpdateOne(ctx,
+		bson.M{"username": user.Username, "recoveryCodes": hashRecoveryCode(code)},
+		bson.M{"$pull": bson.M{"recoveryCodes": hashRecoveryCode(code)}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// GenerateRecoveryCodes returns fresh codes in "xxxx-xxxx" form together
+// with the hashes to store.
+func GenerateRecoveryCodes() ([]string, []string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(encoding.EncodeToString(b))
+		codes[i] = raw[:4] + "-" + raw[4:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	return HashToken(strings.ToLower(strings.ReplaceAll(code, "-", "")))
+}
+
+// EnableTOTP promotes a confirmed pending secret to the active second factor
+// and stores the hashes of a new set of recovery codes.
+func EnableTOTP(ctx context.Context, username, secret string, step int64, recoveryHashes []string) error {
+	_, err := userCollection().UpdateOne(ctx,
+		bson.M{"username": username},
+		bson.M{
+			"$set": bson.M{
+				"totpEnabled":   true,
+				"totpSecret":    secret,
+				"totpLastStep":  step,
+				"recoveryCodes": recoveryHashes,
+			},
+			"$unset": bson.M{"totpPendingSecret": ""},
+		},
+	)
+	return err
+}
+
+// DisableTOTP removes the second factor and all recovery codes.
+func DisableTOTP(ctx context.Context, username string) error {
+	_, err := userCollection().UpdateOne(ctx,
+		bson.M{"username": username},
+		bson.M{
+			"$set": bson.M{"totpEnabled": false},
+			"$unset": bson.M{
+				"totpSecret":        "",
+				"totpPendingSecret": "",
+				"totpLastStep":      "",
+				"recoveryCodes":     "",
+			},
+		},
+	)
+	return err
+}
@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TOTPEnrollHandler starts enrollment by generating a pending secret. The
+// secret only becomes active once TOTPConfirmHandler sees a valid code.
+func TOTPEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := FindUserByUsername(ctx, r.Header.Get("username"))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+	if err := UpdateUser(ctx, user.Username, bson.M{"totpPendingSecret": secret}); err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": TOTPURI(secret, user.Username),
+	})
+}
+
+// TOTPConfirmHandler activates the pending secret and returns the recovery
+// codes. This is the only time the codes are shown.
+func TOTPConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Code == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := FindUserByUsername(ctx, r.Header.Get("username"))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.TOTPPendingSecret == "" {
+		http.Error(w, "No pending enrollment", http.StatusBadRequest)
+		return
+	}
+
+	step, ok := ValidateTOTP(user.TOTPPendingSecret, request.Code, time.Now())
+	if !ok {
+		http.Error(w, ErrInvalidMFACode.Error(), http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+	if err := EnableTOTP(ctx, user.Username, user.TOTPPendingSecret, step, hashes); err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	RecordAuthEvent(r, EventMFAEnabled, user.Username, "totp")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// TOTPDisableHandler turns the second factor off. It needs both the password
+// and a current code so a stolen access token alone cannot remove it.
+func TOTPDisableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Password == "" || request.Code == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := FindUserByUsername(ctx, r.Header.Get("username"))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if !CheckPasswordHash(request.Password, user.Password) {
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return
+	}
+	if err := VerifySecondFactor(ctx, user, request.Code); err != nil {
+		http.Error(w, ErrInvalidMFACode.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := DisableTOTP(ctx, user.Username); err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	RecordAuthEvent(r, EventMFADisabled, user.Username, "totp")
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// RecoveryCodesHandler replaces all recovery codes with a new set.
+func RecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Code == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := FindUserByUsername(ctx, r.Header.Get("username"))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err := VerifySecondFactor(ctx, user, request.Code); err != nil {
+		http.Error(w, ErrInvalidMFACode.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+	if err := UpdateUser(ctx, user.Username, bson.M{"recoveryCodes": hashes}); err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+// LoginMFAHandler is the second step of a login for accounts with TOTP. It
+// trades the "mfa pending" token from /login and a code for a token pair.
+func LoginMFAHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.MFAToken == "" || request.Code == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	challenge, err := ClaimMFAAttempt(ctx, request.MFAToken)
+	if err == ErrInvalidMFAChallenge {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "MFA check failed", http.StatusInternalServerError)
+		return
+	}
+
+	// The login lockout covers second factors as well as passwords.
+	ip := ClientIP(r)
+	wait, err := LoginLockedFor(ctx, challenge.Username, ip)
+	if err != nil {
+		http.Error(w, "MFA check failed", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		RecordAuthEvent(r, EventMFAFailed, challenge.Username, "locked out")
+		tooManyAttempts(w, wait)
+		return
+	}
+
+	user, err := FindUserByUsername(ctx, challenge.Username)
+	if err != nil {
+		http.Error(w, ErrInvalidMFAChallenge.Error(), http.StatusUnauthorized)
+		return
+	}
+	// The account may have been suspended since the first step.
+	if err := CheckAccountUsable(user); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if err := VerifySecondFactor(ctx, user, request.Code); err != nil {
+		RecordAuthEvent(r, EventMFAFailed, user.Username, "wrong code")
+		lockout, err := RecordLoginFailure(ctx, challenge.Username, ip)
+		if err != nil {
+			log.Printf("Failed to record login failure for %s: %v", user.Username, err)
+		}
+		if lockout > 0 {
+			RecordAuthEvent(r, EventLoginLockedOut, user.Username, "locked for "+lockout.String())
+		}
+		http.Error(w, ErrInvalidMFACode.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := CompleteMFAChallenge(ctx, challenge); err != nil {
+		http.Error(w, ErrInvalidMFAChallenge.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := ResetLoginFailures(ctx, user.Username); err != nil {
+		log.Printf("Failed to reset login failures for %s: %v", user.Username, err)
+	}
+
+	tokens, err := IssueTokenPair(ctx, r, user, "")
+	if err != nil {
+		http.Error(w, "JWT error", http.StatusInternalServerError)
+		return
+	}
+	RecordAuthEvent(r, EventLoginSucceeded, user.Username, "password and second factor")
+
+	json.NewEncoder(w).Encode(tokens)
+}
@@ -1,6 +1,350 @@
 package internal
 
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
 type User struct {
-	Username string `json:"username" bson:"username"`
-	Password string `json:"password" bson:"password"`
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Username      string             `json:"username" bson:"username"`
+	Password      string             `json:"-" bson:"password"`
+	Email         string             `json:"email,omitempty" bson:"email,omitempty"`
+	EmailVerified bool               `json:"emailVerified" bson:"emailVerified"`
+	Roles         []string           `json:"roles" bson:"roles,omitempty"`
+	Profile       Profile            `json:"profile" bson:"profile"`
+	CreatedAt     time.Time          `json:"createdAt" bson:"createdAt"`
+
+	// Second factor. TOTPPendingSecret holds a secret between enrollment and
+	// confirmation; RecoveryCodes holds hashes of unused recovery codes.
+	TOTPEnabled       bool     `json:"totpEnabled" bson:"totpEnabled"`
+	TOTPSecret        string   `json:"-" bson:"totpSecret,omitempty"`
+	TOTPPendingSecret string   `json:"-" bson:"totpPendingSecret,omitempty"`
+	TOTPLastStep      int64    `json:"-" bson:"totpLastStep,omitempty"`
+	RecoveryCodes     []string `json:"-" bson:"recoveryCodes,omitempty"`
+
+	// Account state managed by admins. A suspended account cannot get
+	// tokens; PasswordResetRequired blocks logins until the password is reset.
+	Suspended             bool       `json:"suspended" bson:"suspended,omitempty"`
+	SuspendedAt           *time.Time `json:"suspendedAt,omitempty" bson:"suspendedAt,omitempty"`
+	SuspendedReason       string     `json:"suspendedReason,omitempty" bson:"suspendedReason,omitempty"`
+	PasswordResetRequired bool       `json:"passwordResetRequired" bson:"passwordResetRequired,omitempty"`
+
+	// Accounts at external identity providers the user can sign in with.
+	// Users created through one of them have no password.
+	Identities []ExternalIdentity `json:"identities,omitempty" bson:"identities,omitempty"`
+}
+
+// ExternalIdentity links an account to a user at an external OpenID Connect
+// provider, identified by the provider's subject.
+type ExternalIdentity struct {
+	Provider string    `json:"provider" bson:"provider"`
+	Subject  string    `json:"-" bson:"subject"`
+	Email    string    `json:"email,omitempty" bson:"email,omitempty"`
+	LinkedAt time.Time `json:"linkedAt" bson:"linkedAt"`
+}
+
+// Profile holds the public, user editable part of an account.
+type Profile struct {
+	DisplayName string            `json:"displayName" bson:"displayName,omitempty"`
+	Bio         string            `json:"bio" bson:"bio,omitempty"`
+	Website     string            `json:"website" bson:"website,omitempty"`
+	Links       map[string]string `json:"links" bson:"links,omitempty"`
+	AvatarKey   string            `json:"-" bson:"avatarKey,omitempty"`
+}
+
+// RefreshToken is the server-side record of an issued refresh token. Only
+// the SHA-256 hash of the token is stored. Every token issued from the same
+// login shares a FamilyID so that a replayed token can revoke the whole chain.
+type RefreshToken struct {
+	TokenHash string     `bson:"tokenHash"`
+	FamilyID  string     `bson:"familyId"`
+	Username  string     `bson:"username"`
+	CreatedAt time.Time  `bson:"createdAt"`
+	ExpiresAt time.Time  `bson:"expiresAt"`
+	RotatedAt *time.Time `bson:"rotatedAt,omitempty"`
+	Revoked   bool       `bson:"revoked"`
+}
+
+// PasswordReset is a single-use password reset token. Only its hash is stored.
+type PasswordReset struct {
+	TokenHash string     `bson:"tokenHash"`
+	Username  string     `bson:"username"`
+	CreatedAt time.Time  `bson:"createdAt"`
+	ExpiresAt time.Time  `bson:"expiresAt"`
+	UsedAt    *time.Time `bson:"usedAt,omitempty"`
+}
+
+// EmailVerification ties a hashed verification token to the address it
+// was sent to, so changing the address invalidates older links.
+type EmailVerification struct {
+	TokenHash string    `bson:"tokenHash"`
+	Username  string    `bson:"username"`
+	Email     string    `bson:"email"`
+	CreatedAt time.Time `bson:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// MFAChallenge is the server-side half of the "mfa pending" token handed out
+// by /login when the account has a second factor.
+type MFAChallenge struct {
+	TokenHash string    `bson:"tokenHash"`
+	Username  string    `bson:"username"`
+	Attempts  int       `bson:"attempts"`
+	CreatedAt time.Time `bson:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// SigningKey is an RSA key used to sign access tokens. The newest key signs;
+// once retired a key is kept for verification until VerifyUntil.
+type SigningKey struct {
+	Kid         string     `bson:"kid"`
+	Algorithm   string     `bson:"algorithm"`
+	PrivateKey  string     `bson:"privateKey"`
+	CreatedAt   time.Time  `bson:"createdAt"`
+	RetiredAt   *time.Time `bson:"retiredAt,omitempty"`
+	VerifyUntil *time.Time `bson:"verifyUntil,omitempty"`
+}
+
+// JWK is the public part of a SigningKey as published in the JWKS document.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PersonalAccessToken is a long-lived token for scripts and CI. Only the
+// hash is stored; Prefix keeps the first characters so users can tell their
+// tokens apart.
+type PersonalAccessToken struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id"`
+	Username   string             `json:"-" bson:"username"`
+	Name       string             `json:"name" bson:"name"`
+	TokenHash  string             `json:"-" bson:"tokenHash"`
+	Prefix     string             `json:"prefix" bson:"prefix"`
+	Scopes     []string           `json:"scopes" bson:"scopes"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	ExpiresAt  *time.Time         `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	LastUsedAt *time.Time         `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time         `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+}
+
+// Session is one login on one device: the refresh token family started by a
+// login, with where it was started from and when it was last refreshed. Its
+// ID is the family ID and is put into access tokens as the "sid" claim.
+type Session struct {
+	ID         string     `json:"id" bson:"_id"`
+	Username   string     `json:"-" bson:"username"`
+	UserAgent  string     `json:"userAgent" bson:"userAgent"`
+	IP         string     `json:"ip" bson:"ip"`
+	CreatedAt  time.Time  `json:"createdAt" bson:"createdAt"`
+	LastSeenAt time.Time  `json:"lastSeenAt" bson:"lastSeenAt"`
+	ExpiresAt  time.Time  `json:"expiresAt" bson:"expiresAt"`
+	RevokedAt  *time.Time `json:"-" bson:"revokedAt,omitempty"`
+	Current    bool       `json:"current" bson:"-"`
+}
+
+// LoginAttempt counts failures for one key such as "user:alice" or
+// "ip:10.0.0.1". Registration throttling reuses it with "register:<ip>" keys.
+type LoginAttempt struct {
+	Key           string     `bson:"key"`
+	Failures      int        `bson:"failures"`
+	LastFailureAt time.Time  `bson:"lastFailureAt"`
+	LockedUntil   *time.Time `bson:"lockedUntil,omitempty"`
+	ExpiresAt     time.Time  `bson:"expiresAt"`
+}
+
+// TokenPair is returned by /login and /token/refresh.
+type TokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// Revocation marks an access token as no longer valid before its natural
+// expiry. Kind says what Value identifies: "token" entries hold a jti,
+// "session" entries hold a session ID (the "sid" claim) and "user" entries
+// hold a username whose tokens issued before RevokedAt are void.
+type Revocation struct {
+	Kind      string    `json:"kind" bson:"kind"`
+	Value     string    `json:"value" bson:"value"`
+	RevokedAt time.Time `json:"revokedAt" bson:"revokedAt"`
+	ExpiresAt time.Time `json:"expiresAt" bson:"expiresAt"`
+}
+
+// UsernameChange records a rename so it can be replayed against every
+// service that stores usernames. Pending lists the services that have not
+// confirmed the rename yet; the change is done once it is empty.
+type UsernameChange struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	OldUsername string             `json:"oldUsername" bson:"oldUsername"`
+	NewUsername string             `json:"newUsername" bson:"newUsername"`
+	Pending     []string           `json:"pending" bson:"pending"`
+	LastError   string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	Attempts    int                `json:"attempts" bson:"attempts"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+	CompletedAt *time.Time         `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+
+	// Leases maps a service to when the worker carrying the rename to it
+	// may be presumed dead.
+	Leases map[string]time.Time `json:"-" bson:"leases,omitempty"`
+}
+
+// AccountDeletion tracks an account deletion from the request through the
+// grace period to the erasure in every service. It is kept after the user is
+// gone as the record of what was erased.
+type AccountDeletion struct {
+	ID           primitive.ObjectID        `json:"id" bson:"_id,omitempty"`
+	Username     string                    `json:"username" bson:"username"`
+	Email        string                    `json:"-" bson:"email"`
+	Status       string                    `json:"status" bson:"status"`
+	RequestedAt  time.Time                 `json:"requestedAt" bson:"requestedAt"`
+	ScheduledFor time.Time                 `json:"scheduledFor" bson:"scheduledFor"`
+	LeaseUntil   *time.Time                `json:"-" bson:"leaseUntil,omitempty"`
+	Attempts     int                       `json:"attempts" bson:"attempts"`
+	Services     map[string]*ErasureResult `json:"services" bson:"services"`
+	CancelledAt  *time.Time                `json:"cancelledAt,omitempty" bson:"cancelledAt,omitempty"`
+	CompletedAt  *time.Time                `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+}
+
+// ErasureResult is one service's part of an account deletion. Deleted counts
+// the removed records by kind, e.g. {"posts": 3}.
+type ErasureResult struct {
+	Status      string           `json:"status" bson:"status"`
+	Deleted     map[string]int64 `json:"deleted,omitempty" bson:"deleted,omitempty"`
+	Error       string           `json:"error,omitempty" bson:"error,omitempty"`
+	CompletedAt *time.Time       `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+}
+
+// ExportJob collects a copy of everything a user created into a ZIP file.
+// Each source is fetched into its own part so that a job interrupted by a
+// restart continues with the parts it does not have yet.
+type ExportJob struct {
+	ID          primitive.ObjectID     `json:"id" bson:"_id,omitempty"`
+	Username    string                 `json:"-" bson:"username"`
+	Status      string                 `json:"status" bson:"status"`
+	Parts       map[string]*ExportPart `json:"parts" bson:"parts"`
+	Error       string                 `json:"error,omitempty" bson:"error,omitempty"`
+	Attempts    int                    `json:"attempts" bson:"attempts"`
+	RunAfter    time.Time              `json:"-" bson:"runAfter"`
+	LeaseUntil  *time.Time             `json:"-" bson:"leaseUntil,omitempty"`
+	Size        int64                  `json:"size,omitempty" bson:"size,omitempty"`
+	CreatedAt   time.Time              `json:"createdAt" bson:"createdAt"`
+	CompletedAt *time.Time             `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+	ExpiresAt   *time.Time             `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+}
+
+// ExportPart is the state of one source of an export job.
+type ExportPart struct {
+	Status      string     `json:"status" bson:"status"`
+	Error       string     `json:"error,omitempty" bson:"error,omitempty"`
+	CompletedAt *time.Time `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+}
+
+// AdminAuditEntry records one action an admin took on an account.
+type AdminAuditEntry struct {
+	ID        primitive.ObjectID     `json:"id" bson:"_id,omitempty"`
+	Actor     string                 `json:"actor" bson:"actor"`
+	Action    string                 `json:"action" bson:"action"`
+	Target    string                 `json:"target" bson:"target"`
+	Details   map[string]interface{} `json:"details,omitempty" bson:"details,omitempty"`
+	IP        string                 `json:"ip" bson:"ip"`
+	CreatedAt time.Time              `json:"createdAt" bson:"createdAt"`
+}
+
+// SecurityEvent is one entry of the append-only security event log: a
+// login, a failed login, an issued token and the like. UserID is set when
+// the event concerns an existing account.
+type SecurityEvent struct {
+	ID        primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	Type      string              `json:"type" bson:"type"`
+	Actor     string              `json:"actor" bson:"actor"`
+	UserID    *primitive.ObjectID `json:"userId,omitempty" bson:"userId,omitempty"`
+	IP        string              `json:"ip" bson:"ip"`
+	UserAgent string              `json:"userAgent" bson:"userAgent"`
+	Outcome   string              `json:"outcome" bson:"outcome"`
+	CreatedAt time.Time           `json:"createdAt" bson:"createdAt"`
+	ExpiresAt time.Time           `json:"-" bson:"expiresAt"`
+}
+
+// OAuthClient is an application registered to sign users in through
+// auth-service's OpenID Connect provider. Public clients have no secret and
+// rely on PKCE alone.
+type OAuthClient struct {
+	ID           string    `json:"client_id" bson:"_id"`
+	Name         string    `json:"name" bson:"name"`
+	SecretHash   string    `json:"-" bson:"secretHash,omitempty"`
+	Public       bool      `json:"public" bson:"public"`
+	RedirectURIs []string  `json:"redirect_uris" bson:"redirectUris"`
+	CreatedBy    string    `json:"created_by" bson:"createdBy"`
+	CreatedAt    time.Time `json:"created_at" bson:"createdAt"`
+}
+
+// OAuthAuthorization is one run of the authorization code flow. It starts
+// as the request the client sent to /oauth/authorize; once the user approves
+// it holds the hashed code until the client redeems it.
+type OAuthAuthorization struct {
+	ID            string     `bson:"_id"`
+	ClientID      string     `bson:"clientId"`
+	RedirectURI   string     `bson:"redirectUri"`
+	Scopes        []string   `bson:"scopes"`
+	State         string     `bson:"state,omitempty"`
+	Nonce         string     `bson:"nonce,omitempty"`
+	CodeChallenge string     `bson:"codeChallenge"`
+	ForceConsent  bool       `bson:"forceConsent,omitempty"`
+	Username      string     `bson:"username,omitempty"`
+	AuthTime      *time.Time `bson:"authTime,omitempty"`
+	CodeHash      string     `bson:"codeHash,omitempty"`
+	CreatedAt     time.Time  `bson:"createdAt"`
+	ExpiresAt     time.Time  `bson:"expiresAt"`
+	UsedAt        *time.Time `bson:"usedAt,omitempty"`
+}
+
+// OAuthConsent records the scopes a user has allowed a client to receive.
+type OAuthConsent struct {
+	Username  string    `json:"-" bson:"username"`
+	ClientID  string    `json:"client_id" bson:"clientId"`
+	Scopes    []string  `json:"scopes" bson:"scopes"`
+	GrantedAt time.Time `json:"granted_at" bson:"grantedAt"`
+}
+
+// OAuthToken is an access token issued to a client for the userinfo
+// endpoint. Only its hash is stored.
+type OAuthToken struct {
+	TokenHash       string    `bson:"tokenHash"`
+	ClientID        string    `bson:"clientId"`
+	Username        string    `bson:"username"`
+	Scopes          []string  `bson:"scopes"`
+	AuthorizationID string    `bson:"authorizationId"`
+	CreatedAt       time.Time `bson:"createdAt"`
+	ExpiresAt       time.Time `bson:"expiresAt"`
+}
+
+// ExternalLogin is one sign-in through an external provider. It holds the
+// state, nonce and PKCE verifier while the browser is at the provider, and
+// afterwards the hashed one-time code the frontend trades for tokens.
+// LinkUsername is set when a signed-in user is linking the provider instead.
+type ExternalLogin struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	StateHash    string             `bson:"stateHash"`
+	Provider     string             `bson:"provider"`
+	Nonce        string             `bson:"nonce"`
+	CodeVerifier string             `bson:"codeVerifier"`
+	LinkUsername string             `bson:"linkUsername,omitempty"`
+	Username     string             `bson:"username,omitempty"`
+	CodeHash     string             `bson:"codeHash,omitempty"`
+	CreatedAt    time.Time          `bson:"createdAt"`
+	ExpiresAt    time.Time          `bson:"expiresAt"`
+
+	// Claims holds the verified identity of a link attempt until the user
+	// who started it confirms it.
+	Claims *ExternalClaims `bson:"claims,omitempty"`
 }
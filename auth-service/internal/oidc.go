@@ -0,0 +1,465 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Scopes understood by the OpenID Connect provider. openid is required;
+// profile and email add the matching claims to id_tokens and userinfo.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+var oidcScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail}
+
+var (
+	oauthRequestTTL = durationFromEnv("OAUTH_REQUEST_TTL", 10*time.Minute)
+	oauthCodeTTL    = durationFromEnv("OAUTH_CODE_TTL", time.Minute)
+	oauthTokenTTL   = durationFromEnv("OAUTH_TOKEN_TTL", time.Hour)
+)
+
+var (
+	ErrOAuthClientNotFound   = errors.New("client not found")
+	ErrAuthorizationNotFound = errors.New("authorization request not found or expired")
+	ErrInvalidGrant          = errors.New("invalid or expired authorization code")
+	ErrCodeMismatch          = errors.New("code was issued to another client or redirect_uri")
+	ErrPKCEMismatch          = errors.New("code_verifier does not match the code_challenge")
+	ErrInvalidOAuthToken     = errors.New("invalid or expired access token")
+	ErrConsentNotFound       = errors.New("consent not found")
+)
+
+// oidcIssuer is the public base URL of auth-service, used as the "iss" of
+// id_tokens and to build the URLs in the discovery document.
+func oidcIssuer() string {
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		return strings.TrimRight(issuer, "/")
+	}
+	return "http://localhost:8081"
+}
+
+func oauthClientCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("oauth_clients")
+}
+
+func oauthAuthorizationCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("oauth_authorizations")
+}
+
+func oauthConsentCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("oauth_consents")
+}
+
+func oauthTokenCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("oauth_tokens")
+}
+
+// ValidateRedirectURI accepts absolute https URLs, and http URLs on the
+// loopback interface for tools under development.
+func ValidateRedirectURI(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute URL", raw)
+	}
+	if u.Fragment != "" {
+		return fmt.Errorf("%q must not have a fragment", raw)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if host := u.Hostname(); host == "localhost" || host == "127.0.0.1" || host == "::1" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q must use https", raw)
+}
+
+// CreateOAuthClient registers client and returns its secret, which is only
+// stored hashed. Public clients get no secret.
+func CreateOAuthClient(ctx context.Context, client *OAuthClient) (string, error) {
+	id, err := GenerateRandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	client.ID = id
+	client.CreatedAt = time.Now()
+
+	var secret string
+	if !client.Public {
+		if secret, err = GenerateRandomToken(32); err != nil {
+			return "", err
+		}
+		client.SecretHash = HashToken(secret)
+	}
+	if _, err := oauthClientCollection().InsertOne(ctx, client); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func FindOAuthClient(ctx context.Context, id string) (*OAuthClient, error) {
+	var client OAuthClient
+	err := oauthClientCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&client)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrOAuthClientNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// ListOAuthClients returns every registered client, newest first.
+func ListOAuthClients(ctx context.Context) ([]OAuthClient, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cursor, err := oauthClientCollection().Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	clients := make([]OAuthClient, 0)
+	if err = cursor.All(ctx, &clients); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// DeleteOAuthClient removes a client together with its consents, pending
+// authorizations and access tokens.
+func DeleteOAuthClient(ctx context.Context, id string) error {
+	result, err := oauthClientCollection().DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrOAuthClientNotFound
+	}
+	for _, collection := range []*mongo.Collection{oauthConsentCollection(), oauthAuthorizationCollection(), oauthTokenCollection()} {
+		if _, err := collection.DeleteMany(ctx, bson.M{"clientId": id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Authenticate checks the secret a client presented at the token endpoint.
+// Public clients must not present one.
+func (c *OAuthClient) Authenticate(secret string) bool {
+	if c.Public {
+		return secret == ""
+	}
+	return subtle.ConstantTimeCompare([]byte(HashToken(secret)), []byte(c.SecretHash)) == 1
+}
+
+// AllowsRedirect reports whether uri is one of the client's registered
+// redirect URIs. Only exact matches count.
+func (c *OAuthClient) AllowsRedirect(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAuthorization stores a validated authorization request until the
+// user approves or denies it.
+func CreateAuthorization(ctx context.Context, authz *OAuthAuthorization) error {
+	id, err := GenerateRandomToken(16)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	authz.ID = id
+	authz.CreatedAt = now
+	authz.ExpiresAt = now.Add(oauthRequestTTL)
+	_, err = oauthAuthorizationCollection().InsertOne(ctx, authz)
+	return err
+}
+
+// pendingAuthorization matches a request that is still waiting for the user.
+func pendingAuthorization(id string) bson.M {
+	return bson.M{
+		"_id":       id,
+		"codeHash":  bson.M{"$exists": false},
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}
+}
+
+// FindPendingAuthorization returns a request the user has not decided on yet.
+func FindPendingAuthorization(ctx context.Context, id string) (*OAuthAuthorization, error) {
+	var authz OAuthAuthorization
+	err := oauthAuthorizationCollection().FindOne(ctx, pendingAuthorization(id)).Decode(&authz)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrAuthorizationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &authz, nil
+}
+
+// ApproveAuthorization binds a pending request to username and returns the
+// authorization code for the client.
+func ApproveAuthorization(ctx context.Context, id, username string, authTime time.Time) (string, *OAuthAuthorization, error) {
+	code, err := GenerateRandomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var authz OAuthAuthorization
+	err = oauthAuthorizationCollection().FindOneAndUpdate(ctx,
+		pendingAuthorization(id),
+		bson.M{"$set": bson.M{
+			"username":  username,
+			"authTime":  authTime,
+			"codeHash":  HashToken(code),
+			"expiresAt": time.Now().Add(oauthCodeTTL),
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&authz)
+	if err == mongo.ErrNoDocuments {
+		return "", nil, ErrAuthorizationNotFound
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return code, &authz, nil
+}
+
+// DenyAuthorization drops a pending request and returns it so the client
+// can be told.
+func DenyAuthorization(ctx context.Context, id string) (*OAuthAuthorization, error) {
+	var authz OAuthAuthorization
+	err := oauthAuthorizationCollection().FindOneAndDelete(ctx, pendingAuthorization(id)).Decode(&authz)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrAuthorizationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &authz, nil
+}
+
+// RedeemAuthorizationCode marks code as used and returns its authorization,
+// if it was issued to clientID for redirectURI and verifier matches its PKCE
+// challenge. A request that fails these checks leaves the code alone, so it
+// cannot be used to burn another client's code. A code presented twice by
+// its own client has probably leaked, so the tokens issued for it the first
+// time are revoked.
+func RedeemAuthorizationCode(ctx context.Context, code, clientID, redirectURI, verifier string) (*OAuthAuthorization, error) {
+	now := time.Now()
+	codeHash := HashToken(code)
+
+	var authz OAuthAuthorization
+	err := oauthAuthorizationCollection().FindOne(ctx, bson.M{"codeHash": codeHash}).Decode(&authz)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	if authz.ClientID != clientID || authz.RedirectURI != redirectURI {
+		return nil, ErrCodeMismatch
+	}
+	if authz.UsedAt == nil && !VerifyPKCE(authz.CodeChallenge, verifier) {
+		return nil, ErrPKCEMismatch
+	}
+
+	// The record is kept until the tokens it produced expire, so a replay is
+	// still recognised after the code itself has expired.
+	err = oauthAuthorizationCollection().FindOneAndUpdate(ctx,
+		bson.M{"codeHash": codeHash, "clientId": clientID, "redirectUri": redirectURI, "usedAt": nil},
+		bson.M{"$set": bson.M{"usedAt": now, "expiresAt": now.Add(oauthTokenTTL)}},
+	).Decode(&authz)
+	if err == mongo.ErrNoDocuments {
+		log.Printf("Authorization code for %s replayed by client %s, revoking its tokens", authz.Username, authz.ClientID)
+		if _, err := oauthTokenCollection().DeleteMany(ctx, bson.M{"authorizationId": authz.ID}); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	if now.After(authz.ExpiresAt) {
+		return nil, ErrInvalidGrant
+	}
+	return &authz, nil
+}
+
+// VerifyPKCE checks an S256 code_verifier against the stored code_challenge.
+func VerifyPKCE(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// HasConsent reports whether username already allowed clientID every scope
+// in scopes.
+func HasConsent(ctx context.Context, username, clientID string, scopes []string) (bool, error) {
+	count, err := oauthConsentCollection().CountDocuments(ctx, bson.M{
+		"username": username,
+		"clientId": clientID,
+		"scopes":   bson.M{"$all": scopes},
+	})
+	return count > 0, err
+}
+
+// GrantConsent adds scopes to what username allows clientID.
+func GrantConsent(ctx context.Context, username, clientID string, scopes []string) error {
+	_, err := oauthConsentCollection().UpdateOne(ctx,
+		bson.M{"username": username, "clientId": clientID},
+		bson.M{
+			"$addToSet": bson.M{"scopes": bson.M{"$each": scopes}},
+			"$set":      bson.M{"grantedAt": time.Now()},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// ListConsents returns the clients username has allowed, most recent first.
+func ListConsents(ctx context.Context, username string) ([]OAuthConsent, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "grantedAt", Value: -1}})
+	cursor, err := oauthConsentCollection().Find(ctx, bson.M{"username": username}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	consents := make([]OAuthConsent, 0)
+	if err = cursor.All(ctx, &consents); err != nil {
+		return nil, err
+	}
+	return consents, nil
+}
+
+// RevokeConsent withdraws username's consent for clientID and revokes the
+// client's access tokens for the user.
+func RevokeConsent(ctx context.Context, username, clientID string) error {
+	result, err := oauthConsentCollection().DeleteOne(ctx, bson.M{"username": username, "clientId": clientID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrConsentNotFound
+	}
+	_, err = oauthTokenCollection().DeleteMany(ctx, bson.M{"username": username, "clientId": clientID})
+	return err
+}
+
+// IssueOAuthToken stores a new access token for the user and scopes of authz
+// and returns the raw token.
+func IssueOAuthToken(ctx context.Context, authz *OAuthAuthorization) (string, error) {
+	token, err := GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	_, err = oauthTokenCollection().InsertOne(ctx, OAuthToken{
+		TokenHash:       HashToken(token),
+		ClientID:        authz.ClientID,
+		Username:        authz.Username,
+		Scopes:          authz.Scopes,
+		AuthorizationID: authz.ID,
+		CreatedAt:       now,
+		ExpiresAt:       now.Add(oauthTokenTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// LookupOAuthToken returns the record of an unexpired access token.
+func LookupOAuthToken(ctx context.Context, token string) (*OAuthToken, error) {
+	var stored OAuthToken
+	err := oauthTokenCollection().FindOne(ctx, bson.M{
+		"tokenHash": HashToken(token),
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidOAuthToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// OIDCClaims returns the claims about user that scopes allow a client to
+// see. The subject is the account's ID, which survives username changes.
+func OIDCClaims(user *User, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": user.ID.Hex()}
+	for _, scope := range scopes {
+		switch scope {
+		case ScopeProfile:
+			claims["preferred_username"] = user.Username
+			claims["name"] = user.Username
+			if user.Profile.DisplayName != "" {
+				claims["name"] = user.Profile.DisplayName
+			}
+			if profile := NewPublicProfile(user); profile.AvatarURL != "" {
+				claims["picture"] = oidcIssuer() + profile.AvatarURL
+			}
+			if user.Profile.Website != "" {
+				claims["website"] = user.Profile.Website
+			}
+		case ScopeEmail:
+			claims["email"] = user.Email
+			claims["email_verified"] = user.EmailVerified
+		}
+	}
+	return claims
+}
+
+// GenerateIDToken signs the id_token for an approved authorization. It has
+// no "username" claim, so the services never accept it as an access token.
+func GenerateIDToken(user *User, authz *OAuthAuthorization, accessToken string) (string, error) {
+	key, err := signingKeys.current()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims(OIDCClaims(user, authz.Scopes))
+	claims["iss"] = oidcIssuer()
+	claims["aud"] = authz.ClientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(oauthTokenTTL).Unix()
+	if authz.AuthTime != nil {
+		claims["auth_time"] = authz.AuthTime.Unix()
+	}
+	if authz.Nonce != "" {
+		claims["nonce"] = authz.Nonce
+	}
+	// at_hash lets the client check the access token it got alongside.
+	sum := sha256.Sum256([]byte(accessToken))
+	claims["at_hash"] = base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.Kid
+	return token.SignedString(key.private)
+}
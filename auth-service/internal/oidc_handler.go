@@ -0,0 +1,566 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DiscoveryHandler serves the OpenID Connect discovery document at
+// /.well-known/openid-configuration.
+func DiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	issuer := oidcIssuer()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                         issuer,
+		"authorization_endpoint":                         issuer + "/oauth/authorize",
+		"token_endpoint":                                 issuer + "/oauth/token",
+		"userinfo_endpoint":                              issuer + "/oauth/userinfo",
+		"jwks_uri":                                       issuer + "/.well-known/jwks.json",
+		"scopes_supported":                               oidcScopes,
+		"response_types_supported":                       []string{"code"},
+		"grant_types_supported":                          []string{"authorization_code"},
+		"subject_types_supported":                        []string{"public"},
+		"id_token_signing_alg_values_supported":          []string{"RS256"},
+		"token_endpoint_auth_methods_supported":          []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":               []string{"S256"},
+		"authorization_response_iss_parameter_supported": true,
+		"claims_supported": []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "at_hash",
+			"preferred_username", "name", "picture", "website", "email", "email_verified",
+		},
+	})
+}
+
+// oauthRedirectURL adds params, the client's state and our issuer to the
+// client's redirect URI.
+func oauthRedirectURL(redirectURI, state string, params url.Values) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if state != "" {
+		query.Set("state", state)
+	}
+	query.Set("iss", oidcIssuer())
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// AuthorizeHandler starts the authorization code flow at GET
+// /oauth/authorize. Requests with an unknown client or redirect URI are
+// refused outright; other problems are reported to the client's redirect
+// URI. A valid request is stored and the browser is sent to the frontend's
+// consent page, which lets the signed-in user approve or deny it through
+// /oauth/requests/{id}.
+func AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := r.URL.Query()
+	client, err := FindOAuthClient(ctx, query.Get("client_id"))
+	if err == ErrOAuthClientNotFound {
+		http.Error(w, "Unknown client", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Client lookup failed", http.StatusInternalServerError)
+		return
+	}
+	redirectURI := query.Get("redirect_uri")
+	if !client.AllowsRedirect(redirectURI) {
+		http.Error(w, "Redirect URI is not registered for this client", http.StatusBadRequest)
+		return
+	}
+
+	state := query.Get("state")
+	fail := func(code, description string) {
+		http.Redirect(w, r, oauthRedirectURL(redirectURI, state, url.Values{
+			"error":             {code},
+			"error_description": {description},
+		}), http.StatusFound)
+	}
+
+	if query.Get("response_type") != "code" {
+		fail("unsupported_response_type", "only response_type=code is supported")
+		return
+	}
+
+	var scopes []string
+	hasOpenID := false
+	for _, scope := range strings.Fields(query.Get("scope")) {
+		for _, known := range oidcScopes {
+			if scope == known {
+				scopes = append(scopes, scope)
+			}
+		}
+		hasOpenID = hasOpenID || scope == ScopeOpenID
+	}
+	if !hasOpenID {
+		fail("invalid_scope", "the openid scope is required")
+		return
+	}
+	scopes = uniqueStrings(scopes)
+
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		fail("invalid_request", "PKCE with code_challenge_method=S256 is required")
+		return
+	}
+
+	prompt := strings.Fields(query.Get("prompt"))
+	forceConsent := false
+	for _, p := range prompt {
+		switch p {
+		case "none":
+			// Signing in happens in the frontend, never silently here.
+			fail("login_required", "the user must sign in")
+			return
+		case "consent":
+			forceConsent = true
+		}
+	}
+
+	authz := OAuthAuthorization{
+		ClientID:      client.ID,
+		RedirectURI:   redirectURI,
+		Scopes:        scopes,
+		State:         state,
+		Nonce:         query.Get("nonce"),
+		CodeChallenge: query.Get("code_challenge"),
+		ForceConsent:  forceConsent,
+	}
+	if err := CreateAuthorization(ctx, &authz); err != nil {
+		http.Error(w, "Authorization failed", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, appBaseURL()+"/oauth/consent?request="+url.QueryEscape(authz.ID), http.StatusFound)
+}
+
+// AuthorizationRequestHandler lets the consent page show a pending
+// authorization request (GET) and approve or deny it for the signed-in user
+// (POST {"approve": bool}). The POST answers with the URL to send the
+// browser back to the client with.
+func AuthorizationRequestHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/oauth/requests/")
+	if id == "" || strings.Contains(id, "/") {
+		http.Error(w, ErrAuthorizationNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	username := r.Header.Get("username")
+	switch r.Method {
+	case http.MethodGet:
+		authz, err := FindPendingAuthorization(ctx, id)
+		if err == ErrAuthorizationNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Authorization lookup failed", http.StatusInternalServerError)
+			return
+		}
+		client, err := FindOAuthClient(ctx, authz.ClientID)
+		if err != nil {
+			http.Error(w, ErrAuthorizationNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		consented, err := HasConsent(ctx, username, client.ID, authz.Scopes)
+		if err != nil {
+			http.Error(w, "Consent lookup failed", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":               authz.ID,
+			"client":           map[string]string{"client_id": client.ID, "name": client.Name},
+			"scopes":           authz.Scopes,
+			"redirect_uri":     authz.RedirectURI,
+			"consent_required": authz.ForceConsent || !consented,
+			"expires_at":       authz.ExpiresAt,
+		})
+	case http.MethodPost:
+		decideAuthorization(ctx, w, r, id, username)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func decideAuthorization(ctx context.Context, w http.ResponseWriter, r *http.Request, id, username string) {
+	var request struct {
+		Approve bool `json:"approve"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if !request.Approve {
+		authz, err := DenyAuthorization(ctx, id)
+		if err == ErrAuthorizationNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Authorization failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"redirect_to": oauthRedirectURL(authz.RedirectURI, authz.State, url.Values{
+				"error":             {"access_denied"},
+				"error_description": {"the user denied the request"},
+			}),
+		})
+		return
+	}
+
+	user, err := FindUserByUsername(ctx, username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err := CheckAccountUsable(user); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// auth_time is when the user signed in, i.e. when the session started.
+	authTime := time.Now()
+	if session, err := FindSession(ctx, r.Header.Get("sid")); err == nil {
+		authTime = session.CreatedAt
+	}
+
+	code, authz, err := ApproveAuthorization(ctx, id, user.Username, authTime)
+	if err == ErrAuthorizationNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Authorization failed", http.StatusInternalServerError)
+		return
+	}
+	if err := GrantConsent(ctx, user.Username, authz.ClientID, authz.Scopes); err != nil {
+		log.Printf("Failed to store consent of %s for client %s: %v", user.Username, authz.ClientID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"redirect_to": oauthRedirectURL(authz.RedirectURI, authz.State, url.Values{"code": {code}}),
+	})
+}
+
+// oauthError answers a token or userinfo request with an OAuth 2.0 error.
+func oauthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// OAuthTokenHandler redeems an authorization code at POST /oauth/token.
+// Confidential clients authenticate with HTTP Basic or client_secret in the
+// form; every client must send the PKCE code_verifier.
+func OAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "malformed form body")
+		return
+	}
+
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 form-encodes the credentials before they go into the header.
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := FindOAuthClient(ctx, clientID)
+	if err != nil && err != ErrOAuthClientNotFound {
+		oauthError(w, http.StatusInternalServerError, "server_error", "client lookup failed")
+		return
+	}
+	if err == ErrOAuthClientNotFound || !client.Authenticate(secret) {
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+	code := r.PostForm.Get("code")
+	if code == "" {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "code is required")
+		return
+	}
+
+	authz, err := RedeemAuthorizationCode(ctx, code, client.ID, r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+	switch err {
+	case nil:
+	case ErrInvalidGrant, ErrCodeMismatch, ErrPKCEMismatch:
+		oauthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	default:
+		oauthError(w, http.StatusInternalServerError, "server_error", "code lookup failed")
+		return
+	}
+
+	user, err := FindUserByUsername(ctx, authz.Username)
+	if err != nil || CheckAccountUsable(user) != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "the account can no longer sign in")
+		return
+	}
+
+	accessToken, err := IssueOAuthToken(ctx, authz)
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", "token issue failed")
+		return
+	}
+	idToken, err := GenerateIDToken(user, authz, accessToken)
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", "token issue failed")
+		return
+	}
+	RecordAuthEvent(r, EventTokenIssued, user.Username, "oauth client "+client.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int64(oauthTokenTTL.Seconds()),
+		"id_token":     idToken,
+		"scope":        strings.Join(authz.Scopes, " "),
+	})
+}
+
+// UserInfoHandler returns the claims an OAuth access token's scopes allow at
+// GET or POST /oauth/userinfo.
+func UserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	invalid := func(description string) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		oauthError(w, http.StatusUnauthorized, "invalid_token", description)
+	}
+
+	token, ok := BearerToken(r)
+	if !ok {
+		invalid("missing bearer token")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stored, err := LookupOAuthToken(ctx, token)
+	if err == ErrInvalidOAuthToken {
+		invalid(err.Error())
+		return
+	}
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", "token lookup failed")
+		return
+	}
+	user, err := FindUserByUsername(ctx, stored.Username)
+	if err != nil || CheckAccountUsable(user) != nil {
+		invalid("the account can no longer sign in")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(OIDCClaims(user, stored.Scopes))
+}
+
+// ConsentsHandler lists the applications the caller allowed to sign them in
+// at GET /users/me/consents.
+func ConsentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	consents, err := ListConsents(ctx, r.Header.Get("username"))
+	if err != nil {
+		http.Error(w, "Failed to get consents", http.StatusInternalServerError)
+		return
+	}
+
+	type consentView struct {
+		OAuthConsent
+		ClientName string `json:"client_name,omitempty"`
+	}
+	views := make([]consentView, 0, len(consents))
+	for _, consent := range consents {
+		view := consentView{OAuthConsent: consent}
+		if client, err := FindOAuthClient(ctx, consent.ClientID); err == nil {
+			view.ClientName = client.Name
+		}
+		views = append(views, view)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+// ConsentHandler withdraws the caller's consent for one application at
+// DELETE /users/me/consents/{client_id}.
+func ConsentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Only DELETE allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID := strings.TrimPrefix(r.URL.Path, "/users/me/consents/")
+	if clientID == "" || strings.Contains(clientID, "/") {
+		http.Error(w, ErrConsentNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := RevokeConsent(ctx, r.Header.Get("username"), clientID)
+	if err == ErrConsentNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to revoke consent", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminOAuthClientsHandler lists (GET) and registers (POST) OIDC clients at
+// /admin/oauth/clients. The client secret is only returned on creation.
+func AdminOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		clients, err := ListOAuthClients(ctx)
+		if err != nil {
+			http.Error(w, "Failed to get clients", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(clients)
+	case http.MethodPost:
+		var request struct {
+			Name         string   `json:"name"`
+			RedirectURIs []string `json:"redirect_uris"`
+			Public       bool     `json:"public"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Name) == "" || len(request.RedirectURIs) == 0 {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		for _, uri := range request.RedirectURIs {
+			if err := ValidateRedirectURI(uri); err != nil {
+				http.Error(w, "Invalid redirect URI: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		client := OAuthClient{
+			Name:         strings.TrimSpace(request.Name),
+			Public:       request.Public,
+			RedirectURIs: uniqueStrings(request.RedirectURIs),
+			CreatedBy:    r.Header.Get("username"),
+		}
+		secret, err := CreateOAuthClient(ctx, &client)
+		if err != nil {
+			http.Error(w, "DB insert error", http.StatusInternalServerError)
+			return
+		}
+		recordAdminAction(ctx, r, AdminActionCreateOAuthClient, client.ID, map[string]interface{}{
+			"name":          client.Name,
+			"redirect_uris": client.RedirectURIs,
+		})
+
+		response := map[string]interface{}{"client": client}
+		if secret != "" {
+			response["client_secret"] = secret
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(response)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// AdminOAuthClientHandler removes a client at DELETE
+// /admin/oauth/clients/{client_id}. Users' consents and the client's tokens
+// go with it.
+func AdminOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Only DELETE allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/admin/oauth/clients/")
+	if id == "" || strings.Contains(id, "/") {
+		http.Error(w, ErrOAuthClientNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := DeleteOAuthClient(ctx, id)
+	if err == ErrOAuthClientNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete client", http.StatusInternalServerError)
+		return
+	}
+	recordAdminAction(ctx, r, AdminActionDeleteOAuthClient, id, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var passwordResetTTL = durationFromEnv("PASSWORD_RESET_TTL", time.Hour)
+
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+func passwordResetCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("password_resets")
+}
+
+// CreatePasswordReset stores a new reset token for username, replacing any
+// outstanding one, and returns the raw token to be mailed to the user.
+func CreatePasswordReset(ctx context.Context, username string) (string, error) {
+	token, err := GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	collection := passwordResetCollection()
+	if _, err := collection.DeleteMany(ctx, bson.M{"username": username}); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	_, err = collection.InsertOne(ctx, PasswordReset{
+		TokenHash: HashToken(token),
+		Username:  username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(passwordResetTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// PasswordResetUser returns the username a valid reset token belongs to
+// without using the token up.
+func PasswordResetUser(ctx context.Context, token string) (string, error) {
+	var reset PasswordReset
+	err := passwordResetCollection().FindOne(ctx, bson.M{
+		"tokenHash": HashToken(token),
+		"usedAt":    nil,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&reset)
+	if err == mongo.ErrNoDocuments {
+		return "", ErrInvalidResetToken
+	}
+	if err != nil {
+		return "", err
+	}
+	return reset.Username, nil
+}
+
+// ConsumePasswordReset atomically marks a reset token as used and returns the
+// username it was issued for.
+func ConsumePasswordReset(ctx context.Context, token string) (string, error) {
+	now := time.Now()
+	var reset PasswordReset
+	err := passwordResetCollection().FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"tokenHash": HashToken(token),
+			"usedAt":    nil,
+			"expiresAt": bson.M{"$gt": now},
+		},
+		bson.M{"$set": bson.M{"usedAt": now}},
+	).Decode(&reset)
+	if err == mongo.ErrNoDocuments {
+		return "", ErrInvalidResetToken
+	}
+	if err != nil {
+		return "", err
+	}
+	return reset.Username, nil
+}
+
+// mailPasswordReset mails the reset link for token to user. note is added
+// below the link.
+func mailPasswordReset(user *User, token, note string) {
+	link := appBaseURL() + "/reset-password?token=" + token
+	body := fmt.Sprintf("Hi %s,\n\nUse the link below to choose a new password. It expires in %s.\n\n%s\n\n%s",
+		user.Username, passwordResetTTL, link, note)
+	if err := GetMailSender().Send(user.Email, "Reset your password", body); err != nil {
+		log.Printf("Failed to send password reset mail to %s: %v", user.Username, err)
+	}
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PATPrefix marks personal access tokens so the services can tell them
+// apart from JWTs without parsing.
+const PATPrefix = "pat_"
+
+// patLastUsedGranularity throttles last-used writes for busy tokens.
+const patLastUsedGranularity = time.Minute
+
+// PATScopes are the scopes a personal access token can be limited to. A token
+// created without scopes may do anything its owner can.
+var PATScopes = map[string]bool{
+	"posts:write":    true,
+	"comments:write": true,
+	"teams:write":    true,
+}
+
+var ErrPATNotFound = errors.New("access token not found")
+
+func patCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("access_tokens")
+}
+
+// CreatePAT stores a new personal access token and returns the raw token.
+// The raw value is never stored and cannot be shown again.
+func CreatePAT(ctx context.Context, pat *PersonalAccessToken) (string, error) {
+	secret, err := GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	token := PATPrefix + secret
+
+	pat.ID = primitive.NewObjectID()
+	pat.TokenHash = HashToken(token)
+	pat.Prefix = token[:len(PATPrefix)+6]
+	pat.CreatedAt = time.Now()
+	if _, err := patCollection().InsertOne(ctx, pat); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ListPATs returns a user's tokens, newest first, including revoked ones.
+func ListPATs(ctx context.Context, username string) ([]PersonalAccessToken, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cursor, err := patCollection().Find(ctx, bson.M{"username": username}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	tokens := make([]PersonalAccessToken, 0)
+	if err = cursor.All(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// RevokePAT revokes one of username's tokens.
+func RevokePAT(ctx context.Context, username string, id primitive.ObjectID) error {
+	result, err := patCollection().UpdateOne(ctx,
+		bson.M{"_id": id, "username": username, "revokedAt": nil},
+		bson.M{"$set": bson.M{"revokedAt": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrPATNotFound
+	}
+	return nil
+}
+
+// LookupPAT returns the active token matching the raw value and records that
+// it was used.
+func LookupPAT(ctx context.Context, token string) (*PersonalAccessToken, error) {
+	if !strings.HasPrefix(token, PATPrefix) {
+		return nil, ErrPATNotFound
+	}
+
+	now := time.Now()
+	var pat PersonalAccessToken
+	err := patCollection().FindOne(ctx, bson.M{
+		"tokenHash": HashToken(token),
+		"revokedAt": nil,
+		"$or": []bson.M{
+			{"expiresAt": nil},
+			{"expiresAt": bson.M{"$gt": now}},
+		},
+	}).Decode(&pat)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPATNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if pat.LastUsedAt == nil || now.Sub(*pat.LastUsedAt) > patLastUsedGranularity {
+		_, err := patCollection().UpdateOne(ctx, bson.M{"_id": pat.ID}, bson.M{"$set": bson.M{"lastUsedAt": now}})
+		if err != nil {
+			return nil, err
+		}
+		pat.LastUsedAt = &now
+	}
+	return &pat, nil
+}
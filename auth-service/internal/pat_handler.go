@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TokensHandler serves GET (list) and POST (create) on /tokens.
+func TokensHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listPATs(w, r)
+	case http.MethodPost:
+		createPAT(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createPAT(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Name) == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range request.Scopes {
+		if !PATScopes[scope] {
+			http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+	if request.ExpiresInDays < 0 {
+		http.Error(w, "expires_in_days must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	pat := PersonalAccessToken{
+		Username: r.Header.Get("username"),
+		Name:     strings.TrimSpace(request.Name),
+		Scopes:   uniqueStrings(request.Scopes),
+	}
+	if request.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, request.ExpiresInDays)
+		pat.ExpiresAt = &expiresAt
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	token, err := CreatePAT(ctx, &pat)
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	RecordAuthEvent(r, EventTokenIssued, pat.Username, "personal access token "+strconv.Quote(pat.Name))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":        token,
+		"access_token": pat,
+	})
+}
+
+func listPATs(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tokens, err := ListPATs(ctx, r.Header.Get("username"))
+	if err != nil {
+		http.Error(w, "Failed to get tokens", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// RevokeTokenHandler serves DELETE /tokens/{id}.
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Only DELETE allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := primitive.ObjectIDFromHex(strings.TrimPrefix(r.URL.Path, "/tokens/"))
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = RevokePAT(ctx, r.Header.Get("username"), id)
+	if err == ErrPATNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// IntrospectTokenHandler lets the other services validate a personal access
+// token. Inactive tokens get {"active": false} and no other details. Only
+// the services may call it, see RequireServiceKey.
+func IntrospectTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Token == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	pat, err := LookupPAT(ctx, request.Token)
+	if err == ErrPATNotFound {
+		json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+		return
+	}
+	if err != nil {
+		http.Error(w, "Token lookup failed", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := FindUserByUsername(ctx, pat.Username)
+	if err == ErrUserNotFound || (err == nil && CheckAccountUsable(user) != nil) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+		return
+	}
+	if err != nil {
+		http.Error(w, "Token lookup failed", http.StatusInternalServerError)
+		return
+	}
+
+	scopes := pat.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"*"}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"active":         true,
+		"username":       user.Username,
+		"roles":          UserRoles(user),
+		"scopes":         scopes,
+		"email_verified": user.EmailVerified,
+		"expiresAt":      pat.ExpiresAt,
+	})
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Usernames are limited to USERNAME_MIN_LENGTH..USERNAME_MAX_LENGTH
+// characters from USERNAME_ALLOWED_CHARS (a regexp character class body),
+// must start with a letter or digit and may not be one of RESERVED_USERNAMES.
+// Passwords need PASSWORD_MIN_LENGTH characters and may not appear in the
+// bundled list of common and breached passwords.
+var (
+	usernameMinLength = intFromEnv("USERNAME_MIN_LENGTH", 3)
+	usernameMaxLength = intFromEnv("USERNAME_MAX_LENGTH", 32)
+	usernameChars     = regexp.MustCompile("^[" + stringFromEnv("USERNAME_ALLOWED_CHARS", `a-zA-Z0-9_.\-`) + "]+$")
+	reservedUsernames = listFromEnv("RESERVED_USERNAMES", []string{
+		"admin", "administrator", "api", "auth", "auth-service", "help", "login", "logout",
+		"me", "moderator", "register", "root", "security", "staff", "support", "system",
+	})
+
+	passwordMinLength = intFromEnv("PASSWORD_MIN_LENGTH", 10)
+)
+
+// passwordMaxLength caps the input to the password hash.
+const passwordMaxLength = 128
+
+//go:embed common-passwords.txt
+var commonPasswordList string
+
+var (
+	commonPasswordsOnce sync.Once
+	commonPasswords     map[string]bool
+)
+
+// PolicyViolation is one broken rule of the username or password policy.
+type PolicyViolation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func stringFromEnv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// listFromEnv reads a comma separated, lower-cased list from the environment.
+func listFromEnv(key string, def []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// ValidateUsername checks username against the username policy and returns
+// every rule it breaks.
+func ValidateUsername(username string) []PolicyViolation {
+	var violations []PolicyViolation
+	add := func(rule, message string) {
+		violations = append(violations, PolicyViolation{Field: "username", Rule: rule, Message: message})
+	}
+
+	if n := utf8.RuneCountInString(username); n < usernameMinLength || n > usernameMaxLength {
+		add("length", fmt.Sprintf("must be %d to %d characters long", usernameMinLength, usernameMaxLength))
+	}
+	if !usernameChars.MatchString(username) {
+		add("characters", "contains characters that are not allowed")
+	}
+	if first, _ := utf8.DecodeRuneInString(username); !unicode.IsLetter(first) && !unicode.IsDigit(first) {
+		add("start", "must start with a letter or digit")
+	}
+	for _, reserved := range reservedUsernames {
+		if strings.EqualFold(username, reserved) {
+			add("reserved", "is reserved")
+			break
+		}
+	}
+	return violations
+}
+
+// ValidatePassword checks password against the password policy and returns
+// every rule it breaks. username is the account the password is for.
+func ValidatePassword(password, username string) []PolicyViolation {
+	var violations []PolicyViolation
+	add := func(rule, message string) {
+		violations = append(violations, PolicyViolation{Field: "password", Rule: rule, Message: message})
+	}
+
+	n := utf8.RuneCountInString(password)
+	if n < passwordMinLength {
+		add("min_length", fmt.Sprintf("must be at least %d characters long", passwordMinLength))
+	}
+	if n > passwordMaxLength {
+		add("max_length", fmt.Sprintf("must be at most %d characters long", passwordMaxLength))
+	}
+	if strings.TrimSpace(password) == "" {
+		add("blank", "must not be only whitespace")
+	}
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		add("contains_username", "must not contain the username")
+	}
+	if isCommonPassword(password) {
+		add("common", "is too common or has appeared in a data breach")
+	}
+	return violations
+}
+
+func isCommonPassword(password string) bool {
+	commonPasswordsOnce.Do(func() {
+		commonPasswords = make(map[string]bool)
+		for _, line := range strings.Split(commonPasswordList, "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				commonPasswords[line] = true
+			}
+		}
+	})
+	return commonPasswords[strings.ToLower(password)]
+}
+
+// writeViolations answers 400 with every broken rule.
+func writeViolations(w http.ResponseWriter, violations []PolicyViolation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":      "validation failed",
+		"violations": violations,
+	})
+}
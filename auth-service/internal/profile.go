@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 500
+	maxURLLength         = 200
+)
+
+// profileLinkKinds are the social links a profile may list.
+var profileLinkKinds = map[string]bool{
+	"github":   true,
+	"twitter":  true,
+	"linkedin": true,
+	"mastodon": true,
+	"youtube":  true,
+	"medium":   true,
+}
+
+// PublicProfile is what anyone can see about a user.
+type PublicProfile struct {
+	Username    string            `json:"username"`
+	DisplayName string            `json:"displayName,omitempty"`
+	Bio         string            `json:"bio,omitempty"`
+	AvatarURL   string            `json:"avatarUrl,omitempty"`
+	Website     string            `json:"website,omitempty"`
+	Links       map[string]string `json:"links,omitempty"`
+	CreatedAt   *time.Time        `json:"createdAt,omitempty"`
+}
+
+// NewPublicProfile builds the public view of user.
+func NewPublicProfile(user *User) PublicProfile {
+	profile := PublicProfile{
+		Username:    user.Username,
+		DisplayName: user.Profile.DisplayName,
+		Bio:         user.Profile.Bio,
+		Website:     user.Profile.Website,
+		Links:       user.Profile.Links,
+	}
+	if user.Profile.AvatarKey != "" {
+		profile.AvatarURL = "/avatars/" + strings.TrimPrefix(user.Profile.AvatarKey, "avatars/")
+	}
+	if !user.CreatedAt.IsZero() {
+		profile.CreatedAt = &user.CreatedAt
+	}
+	return profile
+}
+
+// ValidateProfile trims the editable profile fields in place and checks
+// their lengths and URLs.
+func ValidateProfile(p *Profile) error {
+	p.DisplayName = strings.TrimSpace(p.DisplayName)
+	p.Bio = strings.TrimSpace(p.Bio)
+	p.Website = strings.TrimSpace(p.Website)
+
+	if utf8.RuneCountInString(p.DisplayName) > maxDisplayNameLength {
+		return fmt.Errorf("displayName must be at most %d characters", maxDisplayNameLength)
+	}
+	if utf8.RuneCountInString(p.Bio) > maxBioLength {
+		return fmt.Errorf("bio must be at most %d characters", maxBioLength)
+	}
+	if p.Website != "" {
+		if err := validateProfileURL(p.Website); err != nil {
+			return fmt.Errorf("website: %v", err)
+		}
+	}
+
+	for kind, link := range p.Links {
+		if !profileLinkKinds[kind] {
+			return fmt.Errorf("unknown link type %q", kind)
+		}
+		link = strings.TrimSpace(link)
+		if link == "" {
+			delete(p.Links, kind)
+			continue
+		}
+		if err := validateProfileURL(link); err != nil {
+			return fmt.Errorf("links.%s: %v", kind, err)
+		}
+		p.Links[kind] = link
+	}
+	return nil
+}
+
+func validateProfileURL(raw string) error {
+	if len(raw) > maxURLLength {
+		return fmt.Errorf("must be at most %d characters", maxURLLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("must be an http or https URL")
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// UserProfileHandler serves the public profile at GET /users/{username}.
+func UserProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := strings.TrimPrefix(r.URL.Path, "/users/")
+	if username == "" || strings.Contains(username, "/") {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := FindUserByUsername(ctx, username)
+	if err == ErrUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewPublicProfile(user))
+}
+
+// MeHandler serves GET (own account), PUT (edit profile) and DELETE
+// (schedule account deletion) on /users/me.
+func MeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getMe(w, r)
+	case http.MethodPut:
+		updateMe(w, r)
+	case http.MethodDelete:
+		deleteMe(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func getMe(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := FindUserByUsername(ctx, r.Header.Get("username"))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"profile":       NewPublicProfile(user),
+		"email":         user.Email,
+		"emailVerified": user.EmailVerified,
+		"roles":         UserRoles(user),
+		"totpEnabled":   user.TOTPEnabled,
+	})
+}
+
+// updateMe replaces the editable profile fields; fields left out are cleared.
+func updateMe(w http.ResponseWriter, r *http.Request) {
+	var profile Profile
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&profile); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if err := ValidateProfile(&profile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	username := r.Header.Get("username")
+	err := UpdateUser(ctx, username, bson.M{
+		"profile.displayName": profile.DisplayName,
+		"profile.bio":         profile.Bio,
+		"profile.website":     profile.Website,
+		"profile.links":       profile.Links,
+	})
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := FindUserByUsername(ctx, username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewPublicProfile(user))
+}
+
+// MyAvatarHandler serves POST (upload) and DELETE on /users/me/avatar. The
+// image is sent either as the "avatar" field of a multipart form or as the
+// raw request body.
+func MyAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	user, err := FindUserByUsername(ctx, r.Header.Get("username"))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	var newKey string
+	if r.Method == http.MethodPost {
+		body := http.MaxBytesReader(w, r.Body, avatarMaxBytes+1<<20)
+		var upload io.Reader = body
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			r.Body = body
+			file, _, err := r.FormFile("avatar")
+			if err != nil {
+				http.Error(w, "Missing avatar file", http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			upload = file
+		}
+
+		processed, err := ProcessAvatar(upload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		suffix, err := GenerateRandomToken(8)
+		if err != nil {
+			http.Error(w, "Failed to store avatar", http.StatusInternalServerError)
+			return
+		}
+		newKey = "avatars/" + user.Username + "-" + suffix + ".png"
+		if err := GetBlobStore().Put(ctx, newKey, bytes.NewReader(processed)); err != nil {
+			log.Printf("Failed to store avatar for %s: %v", user.Username, err)
+			http.Error(w, "Failed to store avatar", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := UpdateUser(ctx, user.Username, bson.M{"profile.avatarKey": newKey}); err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	if user.Profile.AvatarKey != "" {
+		if err := GetBlobStore().Delete(ctx, user.Profile.AvatarKey); err != nil {
+			log.Printf("Failed to delete old avatar %s: %v", user.Profile.AvatarKey, err)
+		}
+	}
+
+	user.Profile.AvatarKey = newKey
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewPublicProfile(user))
+}
+
+// AvatarHandler serves stored avatar images at GET /avatars/{name}.
+func AvatarHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Base(r.URL.Path)
+	if name == "." || name == "/" || name == "avatars" {
+		http.NotFound(w, r)
+		return
+	}
+
+	blob, err := GetBlobStore().Get(r.Context(), "avatars/"+name)
+	if err == ErrBlobNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read avatar", http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	// Avatar keys change on every upload, so they can be cached for long.
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	io.Copy(w, blob)
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenExpired = errors.New("refresh token expired")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+func refreshTokenCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("refresh_tokens")
+}
+
+// IssueTokenPair signs a new access token for user and stores a fresh
+// refresh token in the given family. An empty familyID starts a new family,
+// i.e. a new session on the device that sent r.
+func IssueTokenPair(ctx context.Context, r *http.Request, user *User, familyID string) (*TokenPair, error) {
+	var err error
+	if familyID == "" {
+		familyID, err = GenerateRandomToken(16)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := recordSession(ctx, r, user.Username, familyID); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := GenerateJWT(user, familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := GenerateRandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	record := RefreshToken{
+		TokenHash: HashToken(refreshToken),
+		FamilyID:  familyID,
+		Username:  user.Username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(refreshTokenTTL),
+	}
+	if _, err := refreshTokenCollection().InsertOne(ctx, record); err != nil {
+		return nil, err
+	}
+	RecordAuthEvent(r, EventTokenIssued, user.Username, "session "+familyID)
+
+	return &TokenPair{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// RotateRefreshToken atomically marks the presented refresh token as used and
+// returns its record so the caller can issue the next token in the family.
+// Presenting a token that has already been rotated or revoked revokes every
+// token in its family; the record is returned along with ErrRefreshTokenReused
+// so the caller knows whose session it was.
+func RotateRefreshToken(ctx context.Context, token string) (*RefreshToken, error) {
+	collection := refreshTokenCollection()
+	tokenHash := HashToken(token)
+	now := time.Now()
+
+	var stored RefreshToken
+	err := collection.FindOneAndUpdate(
+		ctx,
+		bson.M{"tokenHash": tokenHash, "rotatedAt": nil, "revoked": false, "expiresAt": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"rotatedAt": now}},
+	).Decode(&stored)
+	if err == nil {
+		return &stored, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	// The token could not be claimed: it is unknown, expired, already used
+	// or revoked.
+	err = collection.FindOne(ctx, bson.M{"tokenHash": tokenHash}).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only a token that was already rotated means someone else holds a copy;
+	// an expired token or one whose session was ended, e.g. by logging out,
+	// is simply no longer good.
+	if stored.RotatedAt == nil || now.After(stored.ExpiresAt) {
+		return nil, ErrRefreshTokenExpired
+	}
+
+	if err := RevokeTokenFamily(ctx, stored.FamilyID); err != nil {
+		return nil, err
+	}
+	log.Printf("Refresh token reuse detected for user %s, revoked family %s", stored.Username, stored.FamilyID)
+	return &stored, ErrRefreshTokenReused
+}
+
+// RevokeTokenFamily ends the session started by one login: every refresh
+// token descended from it is revoked and its access tokens are put on the
+// deny-list.
+func RevokeTokenFamily(ctx context.Context, familyID string) error {
+	_, err := refreshTokenCollection().UpdateMany(
+		ctx,
+		bson.M{"familyId": familyID},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = sessionCollection().UpdateOne(ctx,
+		bson.M{"_id": familyID, "revokedAt": nil},
+		bson.M{"$set": bson.M{"revokedAt": now}},
+	)
+	if err != nil {
+		return err
+	}
+	return Revoke(ctx, revocationKindSession, familyID, now.Add(accessTokenTTL))
+}
+
+// RevokeRefreshToken revokes the family of the given refresh token, if any.
+func RevokeRefreshToken(ctx context.Context, token string) error {
+	var stored RefreshToken
+	err := refreshTokenCollection().FindOne(ctx, bson.M{"tokenHash": HashToken(token)}).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return RevokeTokenFamily(ctx, stored.FamilyID)
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	revocationKindToken   = "token"
+	revocationKindUser    = "user"
+	revocationKindSession = "session"
+)
+
+// Access tokens carry iat in milliseconds, so that a token issued in the
+// same second as a revocation of its user, but after it, stays valid. Tokens
+// from before that have whole-second iats and count as revoked if issued in
+// the second of the revocation.
+func init() {
+	jwt.TimePrecision = time.Millisecond
+}
+
+func revocationCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("revoked_tokens")
+}
+
+// Revoke records a revocation that stays on the deny-list until expiresAt,
+// after which the revoked tokens would have expired anyway.
+func Revoke(ctx context.Context, kind, value string, expiresAt time.Time) error {
+	_, err := revocationCollection().UpdateOne(
+		ctx,
+		bson.M{"kind": kind, "value": value},
+		bson.M{"$set": bson.M{"revokedAt": time.Now(), "expiresAt": expiresAt}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func findRevocation(ctx context.Context, kind, value string) (*Revocation, error) {
+	var rev Revocation
+	err := revocationCollection().FindOne(ctx, bson.M{
+		"kind":      kind,
+		"value":     value,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&rev)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+// IsTokenRevoked checks the deny-list for the token's own jti, for its
+// session and for a revocation of every token its user was issued before a
+// given time.
+func IsTokenRevoked(ctx context.Context, claims jwt.MapClaims) (bool, error) {
+	if jti, ok := claims["jti"].(string); ok {
+		rev, err := findRevocation(ctx, revocationKindToken, jti)
+		if err != nil || rev != nil {
+			return rev != nil, err
+		}
+	}
+
+	if sid, ok := claims["sid"].(string); ok {
+		rev, err := findRevocation(ctx, revocationKindSession, sid)
+		if err != nil || rev != nil {
+			return rev != nil, err
+		}
+	}
+
+	if username, ok := claims["username"].(string); ok {
+		rev, err := findRevocation(ctx, revocationKindUser, username)
+		if err != nil || rev == nil {
+			return false, err
+		}
+		iat, err := claims.GetIssuedAt()
+		if err != nil || iat == nil {
+			return true, nil
+		}
+		return !iat.After(rev.RevokedAt.Truncate(time.Millisecond)), nil
+	}
+	return false, nil
+}
+
+// ListRevocations returns the unexpired revocations recorded at or after since.
+func ListRevocations(ctx context.Context, since time.Time) ([]Revocation, error) {
+	cursor, err := revocationCollection().Find(ctx, bson.M{
+		"revokedAt": bson.M{"$gte": since},
+		"expiresAt": bson.M{"$gt": time.Now()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	revocations := make([]Revocation, 0)
+	if err = cursor.All(ctx, &revocations); err != nil {
+		return nil, err
+	}
+	return revocations, nil
+}
+
+// RevokeUserSessions ends every session of username: all refresh tokens are
+// revoked and access tokens issued before now are put on the deny-list.
+func RevokeUserSessions(ctx context.Context, username string) error {
+	_, err := refreshTokenCollection().UpdateMany(
+		ctx,
+		bson.M{"username": username},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = sessionCollection().UpdateMany(
+		ctx,
+		bson.M{"username": username, "revokedAt": nil},
+		bson.M{"$set": bson.M{"revokedAt": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	return Revoke(ctx, revocationKindUser, username, time.Now().Add(accessTokenTTL))
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	RoleReader    = "reader"
+	RoleAuthor    = "author"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+
+	// RoleSystem is only put into the tokens auth-service mints for its own
+	// calls to the other services. It cannot be granted to users.
+	RoleSystem = "system"
+)
+
+// DefaultRoles are given to every new account. Accounts created before roles
+// existed have none stored and are treated as having these.
+var DefaultRoles = []string{RoleReader, RoleAuthor}
+
+var validRoles = map[string]bool{
+	RoleReader:    true,
+	RoleAuthor:    true,
+	RoleModerator: true,
+	RoleAdmin:     true,
+}
+
+// IsValidRole reports whether role is one of the known roles.
+func IsValidRole(role string) bool {
+	return validRoles[role]
+}
+
+// UserRoles returns the roles to put into the user's tokens.
+func UserRoles(user *User) []string {
+	if len(user.Roles) == 0 {
+		return DefaultRoles
+	}
+	return user.Roles
+}
+
+// EnsureBootstrapAdmins grants the admin role to the comma separated
+// usernames in BOOTSTRAP_ADMINS, so a fresh install has someone who can
+// manage roles.
+func EnsureBootstrapAdmins() {
+	names := os.Getenv("BOOTSTRAP_ADMINS")
+	if names == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		user, err := FindUserByUsername(ctx, name)
+		if err != nil {
+			log.Printf("Bootstrap admin %s: %v", name, err)
+			continue
+		}
+		roles := append(UserRoles(user), RoleAdmin)
+		if err := UpdateUser(ctx, user.Username, bson.M{"roles": uniqueStrings(roles)}); err != nil {
+			log.Printf("Bootstrap admin %s: %v", name, err)
+		}
+	}
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// HasRole reports whether the authenticated request carries any of roles.
+// AuthMiddleware puts the token's roles into the "roles" header.
+func HasRole(r *http.Request, roles ...string) bool {
+	for _, have := range strings.Split(r.Header.Get("roles"), ",") {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequireRole only lets through requests that carry one of roles. It must be
+// wrapped by AuthMiddleware.
+func RequireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !HasRole(r, roles...) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+func sessionCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("sessions")
+}
+
+// recordSession creates or refreshes the session of a token family with the
+// client's current address and user agent. Families issued before sessions
+// were tracked get a session on their next refresh.
+func recordSession(ctx context.Context, r *http.Request, username, sessionID string) error {
+	now := time.Now()
+	_, err := sessionCollection().UpdateOne(ctx,
+		bson.M{"_id": sessionID},
+		bson.M{
+			"$set": bson.M{
+				"username":   username,
+				"userAgent":  r.UserAgent(),
+				"ip":         ClientIP(r),
+				"lastSeenAt": now,
+				"expiresAt":  now.Add(refreshTokenTTL),
+			},
+			"$setOnInsert": bson.M{"createdAt": now},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// ListSessions returns username's active sessions, most recently used first.
+func ListSessions(ctx context.Context, username string) ([]Session, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "lastSeenAt", Value: -1}})
+	cursor, err := sessionCollection().Find(ctx, bson.M{
+		"username":  username,
+		"revokedAt": nil,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	sessions := make([]Session, 0)
+	if err = cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// FindSession returns the session with the given ID.
+func FindSession(ctx context.Context, sessionID string) (*Session, error) {
+	var session Session
+	err := sessionCollection().FindOne(ctx, bson.M{"_id": sessionID}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// RevokeSession ends one of username's sessions: its refresh tokens stop
+// working and its access tokens are put on the deny-list.
+func RevokeSession(ctx context.Context, username, sessionID string) error {
+	count, err := sessionCollection().CountDocuments(ctx, bson.M{"_id": sessionID, "username": username, "revokedAt": nil})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrSessionNotFound
+	}
+	return RevokeTokenFamily(ctx, sessionID)
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SessionsHandler serves GET (list your sessions) and DELETE (log out
+// everywhere) on /sessions.
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	username := r.Header.Get("username")
+	switch r.Method {
+	case http.MethodGet:
+		sessions, err := ListSessions(ctx, username)
+		if err != nil {
+			http.Error(w, "Failed to get sessions", http.StatusInternalServerError)
+			return
+		}
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == r.Header.Get("sid")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions)
+	case http.MethodDelete:
+		if err := RevokeUserSessions(ctx, username); err != nil {
+			http.Error(w, "Logout failed", http.StatusInternalServerError)
+			return
+		}
+		RecordAuthEvent(r, EventLogoutEverywhere, username, "success")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Logged out everywhere"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SessionHandler ends one session at DELETE /sessions/{id}, e.g. the one on
+// a lost laptop.
+func SessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Only DELETE allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/sessions/")
+	if id == "" || strings.Contains(id, "/") {
+		http.Error(w, ErrSessionNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	username := r.Header.Get("username")
+	err := RevokeSession(ctx, username, id)
+	if err == ErrSessionNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	RecordAuthEvent(r, EventSessionRevoked, username, id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
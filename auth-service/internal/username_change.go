@@ -0,0 +1,322 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// usernameChangeRetryInterval is how often pending renames are replayed
+// against services that were unreachable when the rename happened.
+var usernameChangeRetryInterval = durationFromEnv("USERNAME_CHANGE_RETRY_INTERVAL", time.Minute)
+
+// usernameChangeLease is how long a worker may spend carrying one rename to
+// one service before another worker may take it over.
+const usernameChangeLease = time.Minute
+
+// usernameChangeWake starts the worker early when a rename is recorded.
+var usernameChangeWake = make(chan struct{}, 1)
+
+var serviceClient = &http.Client{Timeout: 10 * time.Second}
+
+// downstreamService is a service that stores usernames and exposes the
+// internal endpoints auth-service calls to keep them in sync.
+type downstreamService struct {
+	Name string
+	URL  string
+}
+
+func serviceURL(envKey, productionURL, developmentURL string) string {
+	if os.Getenv("ENVIRONMENT") == "production" {
+		return productionURL
+	}
+	if url := os.Getenv(envKey); url != "" {
+		return url
+	}
+	return developmentURL
+}
+
+func downstreamServices() []downstreamService {
+	return []downstreamService{
+		{Name: "post-service", URL: serviceURL("POST_SERVICE_URL", "http://post-service:80", "http://localhost:8082")},
+		{Name: "comment-service", URL: serviceURL("COMMENT_SERVICE_URL", "http://comment-service:8083", "http://localhost:8083")},
+		{Name: "team-service", URL: serviceURL("TEAM_SERVICE_URL", "http://team-service:8082", "http://localhost:8084")},
+	}
+}
+
+func findDownstreamService(name string) (downstreamService, bool) {
+	for _, service := range downstreamServices() {
+		if service.Name == name {
+			return service, true
+		}
+	}
+	return downstreamService{}, false
+}
+
+// callService POSTs body as JSON to one of the internal endpoints of service,
+// authenticated with a system token. A JSON response is decoded into out
+// unless out is nil.
+func callService(ctx context.Context, service downstreamService, path string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	token, err := GenerateServiceJWT()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, service.URL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s%s returned %s", service.Name, path, resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func usernameChangeCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("username_changes")
+}
+
+// usernameReserved reports whether username was given up by a rename that
+// has not reached every service yet. Handing it out again before then would
+// let the new owner receive the old owner's posts and comments.
+func usernameReserved(ctx context.Context, username string) (bool, error) {
+	count, err := usernameChangeCollection().CountDocuments(ctx,
+		bson.M{"oldUsername": username, "pending.0": bson.M{"$exists": true}},
+		options.Count().SetCollation(caseInsensitive).SetLimit(1),
+	)
+	return count > 0, err
+}
+
+// renamePending reports whether a rename to or from username has not reached
+// every service yet.
+func renamePending(ctx context.Context, username string) (bool, error) {
+	count, err := usernameChangeCollection().CountDocuments(ctx, bson.M{
+		"$or":       []bson.M{{"oldUsername": username}, {"newUsername": username}},
+		"pending.0": bson.M{"$exists": true},
+	}, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+// RenameUser changes oldUsername to newUsername in authdb and records the
+// change so ProcessUsernameChanges can carry it to the other services. All
+// sessions issued under the old name are revoked.
+func RenameUser(ctx context.Context, oldUsername, newUsername string) (*UsernameChange, error) {
+	reserved, err := usernameReserved(ctx, newUsername)
+	if err != nil {
+		return nil, err
+	}
+	if reserved {
+		return nil, ErrUsernameTaken
+	}
+	if existing, err := FindUserByUsername(ctx, newUsername); err == nil && existing.Username != oldUsername {
+		return nil, ErrUsernameTaken
+	}
+
+	// The change is recorded before the user is renamed, so a crash in
+	// between leaves a change to replay rather than a rename nobody knows of.
+	pending := make([]string, 0, len(downstreamServices()))
+	for _, service := range downstreamServices() {
+		pending = append(pending, service.Name)
+	}
+	change := UsernameChange{
+		OldUsername: oldUsername,
+		NewUsername: newUsername,
+		Pending:     pending,
+		CreatedAt:   time.Now(),
+	}
+	inserted, err := usernameChangeCollection().InsertOne(ctx, &change)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := userCollection().UpdateOne(ctx,
+		bson.M{"username": oldUsername},
+		bson.M{"$set": bson.M{"username": newUsername}},
+	)
+	if err == nil && result.MatchedCount == 0 {
+		err = ErrUserNotFound
+	}
+	if err != nil {
+		if _, delErr := usernameChangeCollection().DeleteOne(ctx, bson.M{"_id": inserted.InsertedID}); delErr != nil {
+			log.Printf("Failed to drop username change %s -> %s: %v", oldUsername, newUsername, delErr)
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrUsernameTaken
+		}
+		return nil, err
+	}
+
+	// Records in authdb that follow the user around. Login attempts are keyed
+	// by the lower-cased name and simply start over.
+	db := Client.Database("authdb")
+	for _, collection := range []string{"access_tokens", "password_resets", "email_verifications", "mfa_challenges", "exports", "oauth_authorizations", "oauth_consents", "oauth_tokens", "external_logins"} {
+		_, err := db.Collection(collection).UpdateMany(ctx,
+			bson.M{"username": oldUsername},
+			bson.M{"$set": bson.M{"username": newUsername}},
+		)
+		if err != nil {
+			log.Printf("Failed to rename %s in %s: %v", oldUsername, collection, err)
+		}
+	}
+
+	if err := RevokeUserSessions(ctx, oldUsername); err != nil {
+		log.Printf("Failed to revoke sessions for %s after rename: %v", oldUsername, err)
+	}
+
+	change.ID = inserted.InsertedID.(primitive.ObjectID)
+	select {
+	case usernameChangeWake <- struct{}{}:
+	default:
+	}
+	return &change, nil
+}
+
+// ProcessUsernameChanges replays pending renames against the services. Each
+// service gets its renames one at a time and oldest first, so a chain like
+// a→b, b→a is always applied in order; once a rename fails, later ones are
+// held back for that service until the next run.
+func ProcessUsernameChanges(ctx context.Context) error {
+	names, err := usernameChangeCollection().Distinct(ctx, "pending", bson.M{})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		name, ok := name.(string)
+		if !ok {
+			continue
+		}
+		for {
+			change, err := claimUsernameChange(ctx, name)
+			if err != nil {
+				return err
+			}
+			if change == nil {
+				break
+			}
+			if err := propagateUsernameChange(ctx, change, name); err != nil {
+				log.Printf("Failed to propagate rename %s -> %s to %s: %v", change.OldUsername, change.NewUsername, name, err)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// claimUsernameChange takes the lease on the oldest rename still pending for
+// service. If another worker holds the lease on it, nothing is claimed:
+// taking a newer rename instead could apply the two out of order.
+func claimUsernameChange(ctx context.Context, service string) (*UsernameChange, error) {
+	var oldest UsernameChange
+	err := usernameChangeCollection().FindOne(ctx,
+		bson.M{"pending": service},
+		options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}),
+	).Decode(&oldest)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The claim only succeeds if the rename is still pending for service, so
+	// a rename another worker finished meanwhile is never sent again.
+	now := time.Now()
+	lease := "leases." + service
+	var change UsernameChange
+	err = usernameChangeCollection().FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":     oldest.ID,
+			"pending": service,
+			"$or":     []bson.M{{lease: bson.M{"$exists": false}}, {lease: bson.M{"$lt": now}}},
+		},
+		bson.M{"$set": bson.M{lease: now.Add(usernameChangeLease)}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&change)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// propagateUsernameChange sends a claimed rename to service and records the
+// outcome, releasing the lease either way.
+func propagateUsernameChange(ctx context.Context, change *UsernameChange, name string) error {
+	lease := "leases." + name
+	var callErr error
+	if service, ok := findDownstreamService(name); ok {
+		callCtx, cancel := context.WithTimeout(ctx, usernameChangeLease)
+		callErr = callService(callCtx, service, "/internal/users/rename", map[string]string{
+			"old_username": change.OldUsername,
+			"new_username": change.NewUsername,
+		}, nil)
+		cancel()
+	}
+	// A service that no longer exists has nothing left to rename.
+
+	update := bson.M{"$unset": bson.M{lease: ""}, "$inc": bson.M{"attempts": 1}}
+	if callErr != nil {
+		update["$set"] = bson.M{"lastError": callErr.Error()}
+	} else {
+		update["$pull"] = bson.M{"pending": name}
+	}
+	if _, err := usernameChangeCollection().UpdateByID(ctx, change.ID, update); err != nil {
+		return err
+	}
+	if callErr != nil {
+		return callErr
+	}
+
+	_, err := usernameChangeCollection().UpdateOne(ctx,
+		bson.M{"_id": change.ID, "pending": bson.M{"$size": 0}, "completedAt": nil},
+		bson.M{"$set": bson.M{"completedAt": time.Now()}, "$unset": bson.M{"lastError": ""}},
+	)
+	return err
+}
+
+// StartUsernameChangeWorker carries renames to the services as soon as they
+// are recorded and retries the ones that failed every
+// USERNAME_CHANGE_RETRY_INTERVAL. Every replica runs one; the leases keep
+// them from sending the same rename twice or two renames out of order.
+func StartUsernameChangeWorker() {
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+			if err := ProcessUsernameChanges(ctx); err != nil {
+				log.Printf("Username change worker failed: %v", err)
+			}
+			cancel()
+			select {
+			case <-usernameChangeWake:
+			case <-time.After(usernameChangeRetryInterval):
+			}
+		}
+	}()
+}
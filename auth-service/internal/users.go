@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrUserNotFound  = errors.New("user not found")
+	ErrUsernameTaken = errors.New("username already exists")
+	ErrEmailTaken    = errors.New("email already registered")
+)
+
+// caseInsensitive matches the collation of the unique username and email
+// indexes, so lookups ignore case the same way uniqueness does.
+var caseInsensitive = &options.Collation{Locale: "en", Strength: 2}
+
+func userCollection() *mongo.Collection {
+	return Client.Database("authdb").Collection("users")
+}
+
+// NormalizeEmail lower-cases and trims an email address before it is stored.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// CreateUser inserts a new user and maps unique index violations to
+// ErrUsernameTaken or ErrEmailTaken. Names freed by a rename that is still
+// propagating count as taken.
+func CreateUser(ctx context.Context, user *User) error {
+	reserved, err := usernameReserved(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	if reserved {
+		return ErrUsernameTaken
+	}
+
+	result, err := userCollection().InsertOne(ctx, user)
+	if err == nil {
+		user.ID = result.InsertedID.(primitive.ObjectID)
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		if strings.Contains(err.Error(), "email_unique") {
+			return ErrEmailTaken
+		}
+		return ErrUsernameTaken
+	}
+	return err
+}
+
+// FindUserByUsername looks a user up by username, ignoring case.
+func FindUserByUsername(ctx context.Context, username string) (*User, error) {
+	return findUser(ctx, bson.M{"username": username})
+}
+
+// FindUserByEmail looks a user up by email address, ignoring case.
+func FindUserByEmail(ctx context.Context, email string) (*User, error) {
+	return findUser(ctx, bson.M{"email": NormalizeEmail(email)})
+}
+
+func findUser(ctx context.Context, filter bson.M) (*User, error) {
+	var user User
+	err := userCollection().FindOne(ctx, filter, options.FindOne().SetCollation(caseInsensitive)).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// UpdateUser applies a $set of fields to the user with the given username.
+func UpdateUser(ctx context.Context, username string, fields bson.M) error {
+	result, err := userCollection().UpdateOne(ctx, bson.M{"username": username}, bson.M{"$set": fields})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
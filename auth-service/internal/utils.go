@@ -2,39 +2,165 @@
 package internal
 
 import (
-	"time"
-	"os"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
-	"golang.org/x/crypto/bcrypt"
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-	return string(bytes), err
-}
+var (
+	accessTokenTTL  = durationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+	refreshTokenTTL = durationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+	serviceTokenTTL = 5 * time.Minute
+)
 
-func CheckPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+// durationFromEnv reads a time.Duration such as "15m" from the environment,
+// falling back to def when the variable is unset or malformed.
+func durationFromEnv(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return def
 }
 
-func GenerateJWT(username string) (string, error) {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		return "", errors.New("JWT_SECRET not set")
+// GenerateJWT signs an access token for user that belongs to the session
+// with the given ID.
+func GenerateJWT(user *User, sessionID string) (string, error) {
+	key, err := signingKeys.current()
+	if err != nil {
+		return "", err
+	}
+
+	jti, err := GenerateRandomToken(16)
+	if err != nil {
+		return "", err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": username,
-		"exp":      time.Now().Add(time.Hour * 72).Unix(),
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"username":       user.Username,
+		"email_verified": user.EmailVerified,
+		"roles":          UserRoles(user),
+		"sid":            sessionID,
+		"jti":            jti,
+		"iat":            jwt.NewNumericDate(time.Now()),
+		"exp":            time.Now().Add(accessTokenTTL).Unix(),
 	})
+	token.Header["kid"] = key.Kid
 
-	tokenString, err := token.SignedString([]byte(secret))
+	tokenString, err := token.SignedString(key.private)
 	if err != nil {
 		return "", err
 	}
 
 	return tokenString, nil
-}
\ No newline at end of file
+}
+
+// GenerateServiceJWT mints a short-lived token with the system role that
+// auth-service uses to call the other services' internal endpoints.
+func GenerateServiceJWT() (string, error) {
+	key, err := signingKeys.current()
+	if err != nil {
+		return "", err
+	}
+
+	jti, err := GenerateRandomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"username": "auth-service",
+		"roles":    []string{RoleSystem},
+		"jti":      jti,
+		"iat":      jwt.NewNumericDate(time.Now()),
+		"exp":      time.Now().Add(serviceTokenTTL).Unix(),
+	})
+	token.Header["kid"] = key.Kid
+
+	return token.SignedString(key.private)
+}
+
+// ParseJWT validates an access token issued by GenerateJWT and returns its claims.
+func ParseJWT(tokenStr string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		key, ok := signingKeys.publicKey(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// BearerToken extracts the token from an "Authorization: Bearer ..." header.
+func BearerToken(r *http.Request) (string, bool) {
+	parts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(parts) != 2 || parts[0] != "Bearer" || parts[1] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// ClientIP returns the caller's IP address. X-Forwarded-For is only trusted
+// when TRUST_PROXY=true, i.e. when the service runs behind a proxy that sets it.
+func ClientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// GenerateRandomToken returns n bytes of crypto/rand output, base64url encoded.
+func GenerateRandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex SHA-256 digest used to store opaque tokens.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClaimStrings reads a string array claim such as "roles".
+func ClaimStrings(claims jwt.MapClaims, name string) []string {
+	raw, _ := claims[name].([]interface{})
+	values := make([]string, 0, len(raw))
+	for _, v := range raw {
+		if s, ok := v.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
@@ -18,6 +18,10 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Load auth-service's signing keys and keep the token deny-list in sync
+	internal.StartJWKSRefresh()
+	internal.StartRevocationSync()
+
 	// Initialize repositories
 	commentRepo := internal.NewCommentRepository()
 	friendshipRepo := internal.NewFriendshipRepository()
@@ -30,24 +34,29 @@ func main() {
 	r := mux.NewRouter()
 
 	// Comment routes
-	r.HandleFunc("/posts/{postId}/comments", internal.AuthMiddleware(handler.CreateComment)).Methods("POST")
+	r.HandleFunc("/posts/{postId}/comments", internal.AuthMiddleware(internal.RequireScope(handler.CreateComment, "comments:write"))).Methods("POST")
 	r.HandleFunc("/posts/{postId}/comments", handler.GetCommentsByPost).Methods("GET")
-	r.HandleFunc("/comments/{id}", internal.AuthMiddleware(handler.UpdateComment)).Methods("PUT")
-	r.HandleFunc("/comments/{id}", internal.AuthMiddleware(handler.DeleteComment)).Methods("DELETE")
-	r.HandleFunc("/comments/{id}/like", internal.AuthMiddleware(handler.LikeComment)).Methods("POST")
-	r.HandleFunc("/comments/{id}/unlike", internal.AuthMiddleware(handler.UnlikeComment)).Methods("POST")
+	r.HandleFunc("/comments/{id}", internal.AuthMiddleware(internal.RequireScope(handler.UpdateComment, "comments:write"))).Methods("PUT")
+	r.HandleFunc("/comments/{id}", internal.AuthMiddleware(internal.RequireScope(handler.DeleteComment, "comments:write"))).Methods("DELETE")
+	r.HandleFunc("/comments/{id}/like", internal.AuthMiddleware(internal.RequireScope(handler.LikeComment, "comments:write"))).Methods("POST")
+	r.HandleFunc("/comments/{id}/unlike", internal.AuthMiddleware(internal.RequireScope(handler.UnlikeComment, "comments:write"))).Methods("POST")
 
 	// Post like routes
-	r.HandleFunc("/posts/{postId}/like", internal.AuthMiddleware(handler.LikePost)).Methods("POST")
-	r.HandleFunc("/posts/{postId}/unlike", internal.AuthMiddleware(handler.UnlikePost)).Methods("POST")
+	r.HandleFunc("/posts/{postId}/like", internal.AuthMiddleware(internal.RequireScope(handler.LikePost, "comments:write"))).Methods("POST")
+	r.HandleFunc("/posts/{postId}/unlike", internal.AuthMiddleware(internal.RequireScope(handler.UnlikePost, "comments:write"))).Methods("POST")
 	r.HandleFunc("/posts/{postId}/likes", handler.GetPostLikes).Methods("GET")
 
 	// Friendship routes
-	r.HandleFunc("/friends/request", internal.AuthMiddleware(handler.SendFriendRequest)).Methods("POST")
+	r.HandleFunc("/friends/request", internal.AuthMiddleware(internal.RequireScope(handler.SendFriendRequest, "comments:write"))).Methods("POST")
 	r.HandleFunc("/friends/requests", internal.AuthMiddleware(handler.GetFriendRequests)).Methods("GET")
-	r.HandleFunc("/friends/requests/{id}/accept", internal.AuthMiddleware(handler.AcceptFriendRequest)).Methods("POST")
+	r.HandleFunc("/friends/requests/{id}/accept", internal.AuthMiddleware(internal.RequireScope(handler.AcceptFriendRequest, "comments:write"))).Methods("POST")
 	r.HandleFunc("/friends", internal.AuthMiddleware(handler.GetFriends)).Methods("GET")
 
+	// Internal routes called by auth-service
+	r.HandleFunc("/internal/users/rename", internal.AuthMiddleware(internal.RequireRole(handler.RenameUser, "system"))).Methods("POST")
+	r.HandleFunc("/internal/users/erase", internal.AuthMiddleware(internal.RequireRole(handler.EraseUser, "system"))).Methods("POST")
+	r.HandleFunc("/internal/users/export", internal.AuthMiddleware(internal.RequireRole(handler.ExportUser, "system"))).Methods("POST")
+
 	// Health check
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
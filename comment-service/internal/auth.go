@@ -1,9 +1,7 @@
 package internal
 
 import (
-	"fmt"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -24,18 +22,27 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		tokenStr := bearerToken[1]
-		claims := jwt.MapClaims{}
 
-		token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		if isPAT(tokenStr) {
+			info, err := introspectPAT(tokenStr)
+			if err != nil {
+				http.Error(w, "Token check failed", http.StatusServiceUnavailable)
+				return
 			}
-			secret := os.Getenv("JWT_SECRET")
-			if secret == "" {
-				return nil, fmt.Errorf("JWT_SECRET not set")
+			if !info.Active {
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
 			}
-			return []byte(secret), nil
-		})
+			r.Header.Set("username", info.Username)
+			r.Header.Set("roles", strings.Join(info.Roles, ","))
+			r.Header.Set("scopes", strings.Join(info.Scopes, ","))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims := jwt.MapClaims{}
+
+		token, err := jwt.ParseWithClaims(tokenStr, claims, jwtKeyFunc)
 
 		if err != nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
@@ -47,8 +54,57 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		username := claims["username"].(string)
+		if IsTokenRevoked(claims) {
+			http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+			return
+		}
+
+		// id_tokens from the OIDC provider are signed with the same keys but
+		// carry no username; they are not access tokens.
+		username, _ := claims["username"].(string)
+		if username == "" {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
 		r.Header.Set("username", username)
+		r.Header.Set("roles", strings.Join(claimStrings(claims, "roles"), ","))
+		r.Header.Set("scopes", "*")
 		next.ServeHTTP(w, r)
 	}
-} 
\ No newline at end of file
+}
+
+// HasRole reports whether the authenticated request carries any of roles.
+func HasRole(r *http.Request, roles ...string) bool {
+	for _, have := range strings.Split(r.Header.Get("roles"), ",") {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequireRole only lets through requests whose token carries one of roles.
+// It must be wrapped by AuthMiddleware.
+func RequireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !HasRole(r, roles...) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// claimStrings reads a string array claim such as "roles".
+func claimStrings(claims jwt.MapClaims, name string) []string {
+	raw, _ := claims[name].([]interface{})
+	values := make([]string, 0, len(raw))
+	for _, v := range raw {
+		if s, ok := v.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
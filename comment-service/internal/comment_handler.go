@@ -6,6 +6,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type CommentHandler struct {
@@ -88,6 +89,22 @@ func (h *CommentHandler) DeleteComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	comment, err := h.commentRepo.GetComment(r.Context(), commentID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Moderators and admins may delete any comment, everyone else only their own
+	if comment.Author != r.Header.Get("username") && !HasRole(r, "moderator", "admin") {
+		http.Error(w, "Only the author or a moderator can delete this comment", http.StatusForbidden)
+		return
+	}
+
 	if err := h.commentRepo.DeleteComment(r.Context(), commentID); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -41,6 +41,14 @@ func (r *CommentRepository) GetCommentsByPost(ctx context.Context, postID string
 	return comments, nil
 }
 
+func (r *CommentRepository) GetComment(ctx context.Context, commentID primitive.ObjectID) (*Comment, error) {
+	var comment Comment
+	if err := r.collection.FindOne(ctx, bson.M{"_id": commentID}).Decode(&comment); err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
 func (r *CommentRepository) UpdateComment(ctx context.Context, commentID primitive.ObjectID, content string) error {
 	_, err := r.collection.UpdateOne(
 		ctx,
@@ -78,6 +86,60 @@ func (r *CommentRepository) UnlikeComment(ctx context.Context, commentID primiti
 	return err
 }
 
+// RenameUser moves oldUsername's comments and likes to newUsername.
+func (r *CommentRepository) RenameUser(ctx context.Context, oldUsername, newUsername string) error {
+	_, err := r.collection.UpdateMany(ctx, bson.M{"author": oldUsername}, bson.M{"$set": bson.M{"author": newUsername}})
+	if err != nil {
+		return err
+	}
+	_, err = r.collection.UpdateMany(ctx,
+		bson.M{"likes": oldUsername},
+		bson.M{"$set": bson.M{"likes.$[liker]": newUsername}},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"liker": oldUsername}}}),
+	)
+	return err
+}
+
+// GetCommentsByAuthor returns every comment written by username, oldest first.
+func (r *CommentRepository) GetCommentsByAuthor(ctx context.Context, username string) ([]Comment, error) {
+	return r.findComments(ctx, bson.M{"author": username})
+}
+
+// GetCommentsLikedBy returns every comment username has liked, oldest first.
+func (r *CommentRepository) GetCommentsLikedBy(ctx context.Context, username string) ([]Comment, error) {
+	return r.findComments(ctx, bson.M{"likes": username})
+}
+
+func (r *CommentRepository) findComments(ctx context.Context, filter bson.M) ([]Comment, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}})
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	comments := make([]Comment, 0)
+	if err = cursor.All(ctx, &comments); err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+// EraseUser deletes username's comments and removes their likes from other
+// comments. It returns the number of deleted comments and of comments that
+// lost a like.
+func (r *CommentRepository) EraseUser(ctx context.Context, username string) (int64, int64, error) {
+	deleted, err := r.collection.DeleteMany(ctx, bson.M{"author": username})
+	if err != nil {
+		return 0, 0, err
+	}
+	unliked, err := r.collection.UpdateMany(ctx, bson.M{"likes": username}, bson.M{"$pull": bson.M{"likes": username}})
+	if err != nil {
+		return 0, 0, err
+	}
+	return deleted.DeletedCount, unliked.ModifiedCount, nil
+}
+
 // Friendship repository methods
 type FriendshipRepository struct {
 	collection *mongo.Collection
@@ -155,6 +217,46 @@ func (r *FriendshipRepository) GetFriends(ctx context.Context, username string)
 	return friends, nil
 }
 
+// RenameUser moves oldUsername's friendships to newUsername.
+func (r *FriendshipRepository) RenameUser(ctx context.Context, oldUsername, newUsername string) error {
+	for _, field := range []string{"user1", "user2"} {
+		_, err := r.collection.UpdateMany(ctx, bson.M{field: oldUsername}, bson.M{"$set": bson.M{field: newUsername}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetFriendshipsOf returns every friendship and friend request involving
+// username, whatever its status.
+func (r *FriendshipRepository) GetFriendshipsOf(ctx context.Context, username string) ([]Friendship, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{
+		"$or": []bson.M{{"user1": username}, {"user2": username}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	friendships := make([]Friendship, 0)
+	if err = cursor.All(ctx, &friendships); err != nil {
+		return nil, err
+	}
+	return friendships, nil
+}
+
+// EraseUser deletes every friendship and friend request of username.
+func (r *FriendshipRepository) EraseUser(ctx context.Context, username string) (int64, error) {
+	result, err := r.collection.DeleteMany(ctx, bson.M{
+		"$or": []bson.M{{"user1": username}, {"user2": username}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
 // Post like repository methods
 type PostLikeRepository struct {
 	collection *mongo.Collection
@@ -204,4 +306,34 @@ func (r *PostLikeRepository) HasUserLikedPost(ctx context.Context, postID string
 		"username": username,
 	})
 	return err == nil && count > 0
-} 
\ No newline at end of file
+} 
+
+// RenameUser moves oldUsername's post likes to newUsername.
+func (r *PostLikeRepository) RenameUser(ctx context.Context, oldUsername, newUsername string) error {
+	_, err := r.collection.UpdateMany(ctx, bson.M{"username": oldUsername}, bson.M{"$set": bson.M{"username": newUsername}})
+	return err
+}
+
+// GetLikesByUser returns every post like of username.
+func (r *PostLikeRepository) GetLikesByUser(ctx context.Context, username string) ([]PostLike, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{"username": username})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	likes := make([]PostLike, 0)
+	if err = cursor.All(ctx, &likes); err != nil {
+		return nil, err
+	}
+	return likes, nil
+}
+
+// EraseUser deletes every post like of username.
+func (r *PostLikeRepository) EraseUser(ctx context.Context, username string) (int64, error) {
+	result, err := r.collection.DeleteMany(ctx, bson.M{"username": username})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
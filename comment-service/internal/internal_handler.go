@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// RenameUser applies a username change made in auth-service to comments,
+// likes and friendships. It is only reachable with auth-service's system
+// token and is safe to repeat.
+func (h *CommentHandler) RenameUser(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		OldUsername string `json:"old_username"`
+		NewUsername string `json:"new_username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.OldUsername == "" || request.NewUsername == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.commentRepo.RenameUser(r.Context(), request.OldUsername, request.NewUsername); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := h.postLikeRepo.RenameUser(r.Context(), request.OldUsername, request.NewUsername); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := h.friendshipRepo.RenameUser(r.Context(), request.OldUsername, request.NewUsername); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EraseUser deletes a user's comments, likes and friendships when their
+// account is deleted. It is only reachable with auth-service's system token
+// and is safe to repeat.
+func (h *CommentHandler) EraseUser(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Username == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	comments, commentLikes, err := h.commentRepo.EraseUser(r.Context(), request.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	postLikes, err := h.postLikeRepo.EraseUser(r.Context(), request.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	friendships, err := h.friendshipRepo.EraseUser(r.Context(), request.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"deleted": map[string]int64{
+			"comments":      comments,
+			"comment_likes": commentLikes,
+			"post_likes":    postLikes,
+			"friendships":   friendships,
+		},
+	})
+}
+
+// ExportUser returns a user's comments, likes and friendships for their data
+// export. It is only reachable with auth-service's system token.
+func (h *CommentHandler) ExportUser(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Username == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	comments, err := h.commentRepo.GetCommentsByAuthor(r.Context(), request.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	liked, err := h.commentRepo.GetCommentsLikedBy(r.Context(), request.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	postLikes, err := h.postLikeRepo.GetLikesByUser(r.Context(), request.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	friendships, err := h.friendshipRepo.GetFriendshipsOf(r.Context(), request.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Only say which comments were liked; the comments belong to others.
+	commentLikes := make([]map[string]string, 0, len(liked))
+	for _, comment := range liked {
+		commentLikes = append(commentLikes, map[string]string{
+			"commentId": comment.ID.Hex(),
+			"postId":    comment.PostID,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"comments":      comments,
+		"comment_likes": commentLikes,
+		"post_likes":    postLikes,
+		"friendships":   friendships,
+	})
+}
@@ -2,22 +2,29 @@ package main
 
 import (
 	"log"
-	"fmt"
-	"os"
 	"net/http"
 	"post-service/internal"
+	"strings"
 )
 
 func main() {
 	internal.ConnectMongo()
-	fmt.Println("JWT_KEY:", os.Getenv("JWT_SECRET")) // kontrol için
+	if err := internal.EnsureIndexes(); err != nil {
+		log.Fatalf("Failed to create MongoDB indexes: %v", err)
+	}
+	if err := internal.MigratePosts(); err != nil {
+		log.Fatalf("Failed to migrate old posts: %v", err)
+	}
+	internal.StartJWKSRefresh()
+	internal.StartRevocationSync()
+	internal.StartScheduler()
 
 	http.HandleFunc("/posts", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
 			internal.ListPostsHandler(w, r)
 		case http.MethodPost:
-			internal.AuthMiddleware(internal.CreatePostHandler)(w, r)
+			internal.AuthMiddleware(internal.RequireScope(internal.CreatePostHandler, "posts:write"))(w, r)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -29,18 +36,37 @@ func main() {
 	// Search posts endpoint
 	http.HandleFunc("/posts/search", internal.SearchPostsHandler)
 
-	// Post management endpoint (update and delete)
-	http.HandleFunc("/posts/manage", func(w http.ResponseWriter, r *http.Request) {
+	// The caller's drafts
+	http.HandleFunc("/posts/drafts", internal.AuthMiddleware(internal.DraftsHandler))
+
+	// Single post endpoints: /posts/{id}, /posts/{id}/{action} and
+	// /posts/by-slug/{slug}
+	http.HandleFunc("/posts/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/posts/by-slug/") {
+			internal.OptionalAuth(internal.GetPostBySlugHandler)(w, r)
+			return
+		}
 		switch r.Method {
+		case http.MethodGet:
+			internal.OptionalAuth(internal.GetPostHandler)(w, r)
+		case http.MethodPost:
+			internal.AuthMiddleware(internal.RequireScope(internal.PostActionHandler, "posts:write"))(w, r)
 		case http.MethodPut:
-			internal.AuthMiddleware(internal.UpdatePostHandler)(w, r)
+			internal.AuthMiddleware(internal.RequireScope(internal.UpdatePostHandler, "posts:write"))(w, r)
+		case http.MethodPatch:
+			internal.AuthMiddleware(internal.RequireScope(internal.PatchPostHandler, "posts:write"))(w, r)
 		case http.MethodDelete:
-			internal.AuthMiddleware(internal.DeletePostHandler)(w, r)
+			internal.AuthMiddleware(internal.RequireScope(internal.DeletePostHandler, "posts:write"))(w, r)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
+	// Called by auth-service for renames, account deletion and data exports
+	http.HandleFunc("/internal/users/rename", internal.AuthMiddleware(internal.RequireRole(internal.RenameUserHandler, "system")))
+	http.HandleFunc("/internal/users/erase", internal.AuthMiddleware(internal.RequireRole(internal.EraseUserHandler, "system")))
+	http.HandleFunc("/internal/users/export", internal.AuthMiddleware(internal.RequireRole(internal.ExportUserHandler, "system")))
+
 	log.Println("Post service running on port 8082")
 	log.Fatal(http.ListenAndServe(":8082", nil))
 }
@@ -2,30 +2,112 @@ package internal
 
 import (
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var jwtKey = []byte(os.Getenv("JWT_SECRET"))
-
 func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		tokenStr := r.Header.Get("Authorization")
 		tokenStr = strings.TrimPrefix(tokenStr, "Bearer ")
 
-		claims := jwt.MapClaims{}
-		token, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
+		if isPAT(tokenStr) {
+			info, err := introspectPAT(tokenStr)
+			if err != nil {
+				http.Error(w, "Token check failed", http.StatusServiceUnavailable)
+				return
+			}
+			if !info.Active {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			r.Header.Set("username", info.Username)
+			r.Header.Set("roles", strings.Join(info.Roles, ","))
+			r.Header.Set("scopes", strings.Join(info.Scopes, ","))
+			r.Header.Set("email-verified", strconv.FormatBool(info.EmailVerified))
+			next(w, r)
+			return
+		}
 
+		claims := jwt.MapClaims{}
+		token, err := jwt.ParseWithClaims(tokenStr, claims, jwtKeyFunc)
 		if err != nil || !token.Valid {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		r.Header.Set("username", claims["username"].(string))
+		if IsTokenRevoked(claims) {
+			http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+			return
+		}
+
+		// id_tokens from the OIDC provider are signed with the same keys but
+		// carry no username; they are not access tokens.
+		username, _ := claims["username"].(string)
+		if username == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r.Header.Set("username", username)
+		r.Header.Set("roles", strings.Join(claimStrings(claims, "roles"), ","))
+		r.Header.Set("scopes", "*")
+		verified, _ := claims["email_verified"].(bool)
+		r.Header.Set("email-verified", strconv.FormatBool(verified))
+		next(w, r)
+	}
+}
+
+// OptionalAuth authenticates requests that carry a token like AuthMiddleware
+// and lets the others through anonymously, so public endpoints can show
+// signed-in users more, such as their own drafts.
+func OptionalAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			AuthMiddleware(next)(w, r)
+			return
+		}
+		// Identity headers are ours to set; drop any the client sent.
+		for _, header := range []string{"username", "roles", "scopes", "email-verified"} {
+			r.Header.Del(header)
+		}
+		next(w, r)
+	}
+}
+
+// HasRole reports whether the authenticated request carries any of roles.
+func HasRole(r *http.Request, roles ...string) bool {
+	for _, have := range strings.Split(r.Header.Get("roles"), ",") {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequireRole only lets through requests whose token carries one of roles.
+// It must be wrapped by AuthMiddleware.
+func RequireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !HasRole(r, roles...) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
 		next(w, r)
 	}
 }
+
+// claimStrings reads a string array claim such as "roles".
+func claimStrings(claims jwt.MapClaims, name string) []string {
+	raw, _ := claims[name].([]interface{})
+	values := make([]string, 0, len(raw))
+	for _, v := range raw {
+		if s, ok := v.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
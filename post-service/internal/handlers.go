@@ -3,10 +3,15 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 	"log"
 	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 var (
@@ -20,6 +25,21 @@ func initializeRepo() {
 	})
 }
 
+// MigratePosts brings posts written by older versions up to date: they get
+// a slug and, as they were public, the published status. main runs it on
+// start, before serving requests.
+func MigratePosts() error {
+	initializeRepo()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := postRepo.BackfillStatus(ctx); err != nil {
+		return err
+	}
+	return postRepo.BackfillSlugs(ctx)
+}
+
 func CreatePostHandler(w http.ResponseWriter, r *http.Request) {
 	initializeRepo()
 	
@@ -35,7 +55,39 @@ func CreatePostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	post.Author = r.Header.Get("username")
-	
+	tags, err := cleanTags(post.Tags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	coAuthors, err := cleanCoAuthors(post.CoAuthors, post.Author)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	post.Tags, post.CoAuthors = tags, coAuthors
+
+	// New posts are drafts unless they ask to be published right away.
+	// Scheduling goes through POST /posts/{id}/schedule.
+	post.PublishedAt, post.ScheduledAt = nil, nil
+	switch post.Status {
+	case "":
+		post.Status = StatusDraft
+	case StatusDraft:
+	case StatusPublished:
+		// Anyone may write drafts; making a post public takes a verified
+		// email.
+		if r.Header.Get("email-verified") != "true" {
+			http.Error(w, "Email address must be verified", http.StatusForbidden)
+			return
+		}
+		now := clock.Now()
+		post.PublishedAt = &now
+	default:
+		http.Error(w, "status must be draft or published", http.StatusBadRequest)
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -45,17 +97,85 @@ func CreatePostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("Location", "/posts/"+post.ID.Hex())
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Post created"})
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Post created",
+		"id":      post.ID.Hex(),
+		"slug":    post.Slug,
+		"status":  post.Status,
+	})
 }
 
+// ListPostsHandler lists published posts at GET /posts, a page at a time.
+// Query parameters: limit, cursor, sort (newest or oldest), author, tag, from
+// and to.
 func ListPostsHandler(w http.ResponseWriter, r *http.Request) {
 	initializeRepo()
-	
+
+	query, err := parsePostQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	listPosts(w, query)
+}
+
+// GetPostsByAuthorHandler lists an author's published posts at GET
+// /posts/author?author=..., with the parameters of ListPostsHandler.
+func GetPostsByAuthorHandler(w http.ResponseWriter, r *http.Request) {
+	initializeRepo()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := parsePostQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.Author == "" {
+		http.Error(w, "Author parameter is required", http.StatusBadRequest)
+		return
+	}
+	listPosts(w, query)
+}
+
+// DraftsHandler lists the drafts the caller is an author or co-author of at
+// GET /posts/drafts, with the parameters of ListPostsHandler.
+func DraftsHandler(w http.ResponseWriter, r *http.Request) {
+	initializeRepo()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := parsePostQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.Status = StatusDraft
+	query.Member = r.Header.Get("username")
+	listPosts(w, query)
+}
+
+func listPosts(w http.ResponseWriter, query PostQuery) {
+	if query.Status == "" {
+		query.Status = StatusPublished
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	posts, err := postRepo.GetAllPosts(ctx)
+	page, err := postRepo.ListPosts(ctx, query)
+	if err == ErrInvalidCursor {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to get posts: %v", err)
 		http.Error(w, "Failed to get posts", http.StatusInternalServerError)
@@ -63,88 +183,435 @@ func ListPostsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(posts)
+	json.NewEncoder(w).Encode(page)
 }
 
-func GetPostsByAuthorHandler(w http.ResponseWriter, r *http.Request) {
+// postIDFromPath reads the ID from a /posts/{id} path.
+func postIDFromPath(r *http.Request) (primitive.ObjectID, bool) {
+	id, err := primitive.ObjectIDFromHex(strings.TrimPrefix(r.URL.Path, "/posts/"))
+	return id, err == nil
+}
+
+// GetPostHandler returns one post at GET /posts/{id}. Posts that are not
+// published are only shown to those who can edit them.
+func GetPostHandler(w http.ResponseWriter, r *http.Request) {
 	initializeRepo()
-	
+
 	if r.Method != http.MethodGet {
 		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	author := r.URL.Query().Get("author")
-	if author == "" {
-		http.Error(w, "Author parameter is required", http.StatusBadRequest)
+	id, ok := postIDFromPath(r)
+	if !ok {
+		http.Error(w, "Post not found", http.StatusNotFound)
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	posts, err := postRepo.GetPostsByAuthor(ctx, author)
+	post, err := postRepo.GetPostByID(ctx, id)
+	if err == nil && !canSeePost(r, post) {
+		err = ErrPostNotFound
+	}
+	if err == ErrPostNotFound {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to get posts by author: %v", err)
-		http.Error(w, "Failed to get posts", http.StatusInternalServerError)
+		log.Printf("Failed to get post: %v", err)
+		http.Error(w, "Failed to get post", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(post)
+}
+
+// GetPostBySlugHandler returns one post at GET /posts/by-slug/{slug}. Slugs
+// a post had before it was renamed redirect to its current one.
+func GetPostBySlugHandler(w http.ResponseWriter, r *http.Request) {
+	initializeRepo()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	slug := strings.TrimPrefix(r.URL.Path, "/posts/by-slug/")
+	if slug == "" {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	post, err := postRepo.GetPostBySlug(ctx, slug)
+	if err == nil && !canSeePost(r, post) {
+		err = ErrPostNotFound
+	}
+	if err == ErrPostNotFound {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get post: %v", err)
+		http.Error(w, "Failed to get post", http.StatusInternalServerError)
+		return
+	}
+	if post.Slug != slug {
+		http.Redirect(w, r, "/posts/by-slug/"+post.Slug, http.StatusMovedPermanently)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(posts)
+	json.NewEncoder(w).Encode(post)
+}
+
+// maxCoAuthors limits how many co-authors a post can have.
+const maxCoAuthors = 10
+
+// isModerator reports whether the request may change any post.
+func isModerator(r *http.Request) bool {
+	return HasRole(r, "moderator", "admin")
+}
+
+// canEditPost reports whether the request may change the post's title and
+// content: its author, a co-author or a moderator.
+func canEditPost(r *http.Request, post *Post) bool {
+	username := r.Header.Get("username")
+	if post.Author == username || isModerator(r) {
+		return true
+	}
+	for _, coAuthor := range post.CoAuthors {
+		if coAuthor == username {
+			return true
+		}
+	}
+	return false
+}
+
+// canManagePost reports whether the request may choose the post's co-authors
+// or delete it: only its author or a moderator.
+func canManagePost(r *http.Request, post *Post) bool {
+	return post.Author == r.Header.Get("username") || isModerator(r)
+}
+
+// canSeePost reports whether the request may read the post: anyone once it
+// is published, before that and after archiving only its editors.
+func canSeePost(r *http.Request, post *Post) bool {
+	return post.Status == StatusPublished || canEditPost(r, post)
+}
+
+// cleanCoAuthors trims and de-duplicates co-author names and checks them
+// against author.
+func cleanCoAuthors(names []string, author string) ([]string, error) {
+	seen := make(map[string]bool)
+	cleaned := []string{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		if name == author {
+			return nil, errors.New("the author cannot also be a co-author")
+		}
+		seen[name] = true
+		cleaned = append(cleaned, name)
+	}
+	if len(cleaned) > maxCoAuthors {
+		return nil, fmt.Errorf("a post can have at most %d co-authors", maxCoAuthors)
+	}
+	return cleaned, nil
 }
 
+// maxTags limits how many tags a post can have.
+const maxTags = 10
+
+// cleanTags lower-cases, trims and de-duplicates tags.
+func cleanTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool)
+	cleaned := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		cleaned = append(cleaned, tag)
+	}
+	if len(cleaned) > maxTags {
+		return nil, fmt.Errorf("a post can have at most %d tags", maxTags)
+	}
+	return cleaned, nil
+}
+
+// UpdatePostHandler replaces a post's title and content at PUT /posts/{id}.
 func UpdatePostHandler(w http.ResponseWriter, r *http.Request) {
 	initializeRepo()
-	
+
 	if r.Method != http.MethodPut {
 		http.Error(w, "Only PUT allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	title := r.URL.Query().Get("title")
-	if title == "" {
-		http.Error(w, "Title parameter is required", http.StatusBadRequest)
+	var request struct {
+		Title   string `json:"title"`
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
 
-	var post Post
-	if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
+	updatePost(w, r, PostUpdate{Title: &request.Title, Content: &request.Content})
+}
+
+// PatchPostHandler changes some fields of a post at PATCH /posts/{id}: title,
+// content, tags and coAuthors. Only the author or a moderator may change
+// coAuthors; the author and the creation time never change.
+func PatchPostHandler(w http.ResponseWriter, r *http.Request) {
+	initializeRepo()
+
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Only PATCH allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var update PostUpdate
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&update); err != nil {
+		if strings.HasPrefix(err.Error(), "json: unknown field") {
+			http.Error(w, "Only title, content, tags and coAuthors can be changed", http.StatusBadRequest)
+			return
+		}
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
+	if update.Title == nil && update.Content == nil && update.Tags == nil && update.CoAuthors == nil {
+		http.Error(w, "Nothing to change", http.StatusBadRequest)
+		return
+	}
+
+	updatePost(w, r, update)
+}
+
+// updatePost applies update to the post at /posts/{id} if the request may
+// make the change, and answers with the updated post.
+func updatePost(w http.ResponseWriter, r *http.Request, update PostUpdate) {
+	id, ok := postIDFromPath(r)
+	if !ok {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if update.Title != nil && strings.TrimSpace(*update.Title) == "" {
+		http.Error(w, "Title cannot be empty", http.StatusBadRequest)
+		return
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := postRepo.UpdatePost(ctx, title, &post); err != nil {
+	post, err := postRepo.GetPostByID(ctx, id)
+	if err == nil && !canSeePost(r, post) {
+		err = ErrPostNotFound
+	}
+	if err == ErrPostNotFound {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get post: %v", err)
+		http.Error(w, "Failed to update post", http.StatusInternalServerError)
+		return
+	}
+
+	if !canEditPost(r, post) {
+		http.Error(w, "Only the author, a co-author or a moderator can edit this post", http.StatusForbidden)
+		return
+	}
+	if update.Tags != nil {
+		tags, err := cleanTags(*update.Tags)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		update.Tags = &tags
+	}
+	if update.CoAuthors != nil {
+		if !canManagePost(r, post) {
+			http.Error(w, "Only the author or a moderator can change co-authors", http.StatusForbidden)
+			return
+		}
+		coAuthors, err := cleanCoAuthors(*update.CoAuthors, post.Author)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		update.CoAuthors = &coAuthors
+	}
+
+	err = postRepo.UpdatePost(ctx, id, update)
+	if err == ErrPostNotFound {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if err == ErrSlugConflict {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
 		log.Printf("Failed to update post: %v", err)
 		http.Error(w, "Failed to update post", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Post updated"})
+	updated, err := postRepo.GetPostByID(ctx, id)
+	if err != nil {
+		log.Printf("Failed to get post: %v", err)
+		http.Error(w, "Failed to get post", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// postActions maps the actions of PostActionHandler to the status they
+// move a post to.
+var postActions = map[string]string{
+	"publish":   StatusPublished,
+	"unpublish": StatusDraft,
+	"archive":   StatusArchived,
+}
+
+// PostActionHandler changes a post's status at POST /posts/{id}/publish,
+// /posts/{id}/unpublish (back to draft) and /posts/{id}/archive, and
+// schedules a draft to be published at POST /posts/{id}/schedule with
+// {"scheduledAt": RFC 3339 time}. Only the author or a moderator may do so,
+// and publishing or scheduling needs a verified email.
+func PostActionHandler(w http.ResponseWriter, r *http.Request) {
+	initializeRepo()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rawID, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/posts/"), "/")
+	id, err := primitive.ObjectIDFromHex(rawID)
+	status, ok := postActions[action]
+	if err != nil || !(ok || action == "schedule") {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	// Making a post public takes a verified email, as creating one does.
+	if (status == StatusPublished || action == "schedule") && r.Header.Get("email-verified") != "true" {
+		http.Error(w, "Email address must be verified", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	post, err := postRepo.GetPostByID(ctx, id)
+	if err == nil && !canSeePost(r, post) {
+		err = ErrPostNotFound
+	}
+	if err == ErrPostNotFound {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get post: %v", err)
+		http.Error(w, "Failed to update post", http.StatusInternalServerError)
+		return
+	}
+	if !canManagePost(r, post) {
+		http.Error(w, "Only the author or a moderator can "+action+" this post", http.StatusForbidden)
+		return
+	}
+
+	if action == "schedule" {
+		var req struct {
+			ScheduledAt time.Time `json:"scheduledAt"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ScheduledAt.IsZero() {
+			http.Error(w, "scheduledAt must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		if !req.ScheduledAt.After(clock.Now()) {
+			http.Error(w, "scheduledAt must be in the future", http.StatusBadRequest)
+			return
+		}
+		err = postRepo.SchedulePost(ctx, id, req.ScheduledAt.UTC())
+	} else {
+		err = postRepo.SetPostStatus(ctx, id, status)
+	}
+	if err == ErrPostNotDraft {
+		http.Error(w, "Only drafts can be scheduled", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to %s post: %v", action, err)
+		http.Error(w, "Failed to update post", http.StatusInternalServerError)
+		return
+	}
+
+	updated, err := postRepo.GetPostByID(ctx, id)
+	if err != nil {
+		log.Printf("Failed to get post: %v", err)
+		http.Error(w, "Failed to get post", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
 }
 
+// DeletePostHandler deletes a post at DELETE /posts/{id}.
 func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
 	initializeRepo()
-	
+
 	if r.Method != http.MethodDelete {
 		http.Error(w, "Only DELETE allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	title := r.URL.Query().Get("title")
-	if title == "" {
-		http.Error(w, "Title parameter is required", http.StatusBadRequest)
+	id, ok := postIDFromPath(r)
+	if !ok {
+		http.Error(w, "Post not found", http.StatusNotFound)
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := postRepo.DeletePost(ctx, title); err != nil {
+	post, err := postRepo.GetPostByID(ctx, id)
+	if err == nil && !canSeePost(r, post) {
+		err = ErrPostNotFound
+	}
+	if err == ErrPostNotFound {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get post: %v", err)
+		http.Error(w, "Failed to delete post", http.StatusInternalServerError)
+		return
+	}
+
+	// Moderators and admins may delete any post, everyone else only their
+	// own; co-authors may edit but not delete
+	if !canManagePost(r, post) {
+		http.Error(w, "Only the author or a moderator can delete this post", http.StatusForbidden)
+		return
+	}
+
+	if err := postRepo.DeletePost(ctx, id); err != nil {
 		log.Printf("Failed to delete post: %v", err)
 		http.Error(w, "Failed to delete post", http.StatusInternalServerError)
 		return
@@ -154,30 +621,25 @@ func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"message": "Post deleted"})
 }
 
+// SearchPostsHandler lists published posts whose title or content contains q at GET
+// /posts/search?q=..., with the parameters of ListPostsHandler.
 func SearchPostsHandler(w http.ResponseWriter, r *http.Request) {
 	initializeRepo()
-	
+
 	if r.Method != http.MethodGet {
 		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	query := r.URL.Query().Get("q")
-	if query == "" {
-		http.Error(w, "Search query parameter 'q' is required", http.StatusBadRequest)
+	query, err := parsePostQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	posts, err := postRepo.SearchPosts(ctx, query)
-	if err != nil {
-		log.Printf("Failed to search posts: %v", err)
-		http.Error(w, "Failed to search posts", http.StatusInternalServerError)
+	query.Search = strings.TrimSpace(r.URL.Query().Get("q"))
+	if query.Search == "" {
+		http.Error(w, "Search query parameter 'q' is required", http.StatusBadRequest)
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(posts)
+	listPosts(w, query)
 }
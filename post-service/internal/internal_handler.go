@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// RenameUserHandler applies a username change made in auth-service. It is
+// only reachable with auth-service's system token and is safe to repeat.
+func RenameUserHandler(w http.ResponseWriter, r *http.Request) {
+	initializeRepo()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		OldUsername string `json:"old_username"`
+		NewUsername string `json:"new_username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.OldUsername == "" || request.NewUsername == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := postRepo.RenameAuthor(ctx, request.OldUsername, request.NewUsername); err != nil {
+		http.Error(w, "Failed to rename user", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EraseUserHandler deletes everything post-service holds about a user whose
+// account is being deleted. It is only reachable with auth-service's system
+// token and is safe to repeat.
+func EraseUserHandler(w http.ResponseWriter, r *http.Request) {
+	initializeRepo()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Username == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	posts, err := postRepo.DeletePostsByAuthor(ctx, request.Username)
+	if err != nil {
+		http.Error(w, "Failed to erase user", http.StatusInternalServerError)
+		return
+	}
+	coAuthorships, err := postRepo.RemoveCoAuthor(ctx, request.Username)
+	if err != nil {
+		http.Error(w, "Failed to erase user", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"deleted": map[string]int64{"posts": posts, "co_authorships": coAuthorships},
+	})
+}
+
+// ExportUserHandler returns a user's posts for their data export. It is only
+// reachable with auth-service's system token.
+func ExportUserHandler(w http.ResponseWriter, r *http.Request) {
+	initializeRepo()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Username == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	posts, err := postRepo.GetPostsByAuthor(ctx, request.Username)
+	if err != nil {
+		http.Error(w, "Failed to export user", http.StatusInternalServerError)
+		return
+	}
+	if posts == nil {
+		posts = []Post{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"posts": posts})
+}
@@ -1,10 +1,43 @@
 package internal
 
-import "time"
+import (
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Post is a blog post. Slug is derived from the title and changes with it;
+// PreviousSlugs keeps the old ones so links to them can be redirected.
+// CoAuthors may edit the post alongside its author. Only published posts are
+// public; PublishedAt is when the post was first published. A draft with
+// ScheduledAt set is published by the scheduler once that time has come.
 type Post struct {
-	Title     string    `json:"title" bson:"title"`
-	Content   string    `json:"content" bson:"content"`
-	Author    string    `json:"author" bson:"author"`
-	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Slug          string             `json:"slug" bson:"slug"`
+	PreviousSlugs []string           `json:"-" bson:"previousSlugs,omitempty"`
+	Title         string             `json:"title" bson:"title"`
+	Content       string             `json:"content" bson:"content"`
+	Tags          []string           `json:"tags,omitempty" bson:"tags,omitempty"`
+	Author        string             `json:"author" bson:"author"`
+	CoAuthors     []string           `json:"coAuthors,omitempty" bson:"coAuthors,omitempty"`
+	Status        string             `json:"status" bson:"status"`
+	CreatedAt     time.Time          `json:"createdAt" bson:"createdAt"`
+	PublishedAt   *time.Time         `json:"publishedAt,omitempty" bson:"publishedAt,omitempty"`
+	ScheduledAt   *time.Time         `json:"scheduledAt,omitempty" bson:"scheduledAt,omitempty"`
+}
+
+// Post statuses.
+const (
+	StatusDraft     = "draft"
+	StatusPublished = "published"
+	StatusArchived  = "archived"
+)
+
+// PostUpdate changes some fields of a post; nil fields are left alone. The
+// author and the creation time cannot be changed.
+type PostUpdate struct {
+	Title     *string   `json:"title"`
+	Content   *string   `json:"content"`
+	Tags      *[]string `json:"tags"`
+	CoAuthors *[]string `json:"coAuthors"`
 }
@@ -2,10 +2,12 @@ package internal
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -41,3 +43,36 @@ func ConnectMongo() {
 	log.Println("Successfully connected to MongoDB")
 	Client = client
 }
+
+// EnsureIndexes creates the indexes post-service relies on.
+func EnsureIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := Client.Database(databaseName).Collection(collectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// Posts written before slugs existed get one from BackfillSlugs.
+			Keys: bson.D{{Key: "slug", Value: 1}},
+			Options: options.Index().SetName("slug_unique").SetUnique(true).
+				SetPartialFilterExpression(bson.M{"slug": bson.M{"$type": "string"}}),
+		},
+		{Keys: bson.D{{Key: "previousSlugs", Value: 1}}},
+		// Published listings page through (publishedAt, _id), optionally by
+		// author or tag; drafts page through (createdAt, _id).
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "publishedAt", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "author", Value: 1}, {Key: "status", Value: 1}, {Key: "publishedAt", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "tags", Value: 1}, {Key: "status", Value: 1}, {Key: "publishedAt", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "coAuthors", Value: 1}, {Key: "status", Value: 1}}},
+		// The scheduler looks for drafts that are due.
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "scheduledAt", Value: 1}},
+			Options: options.Index().
+				SetPartialFilterExpression(bson.M{"scheduledAt": bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("posts index error: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+
+	SortNewest = "newest"
+	SortOldest = "oldest"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// PostQuery selects one page of a post listing. Zero fields match every
+// post.
+type PostQuery struct {
+	Status string
+	// Member matches posts the user is the author or a co-author of.
+	Member string
+	Author string
+	Tag    string
+	Search string
+	From   time.Time
+	To     time.Time
+	Sort   string
+	Limit  int64
+	Cursor *PostCursor
+}
+
+// PostCursor marks the last post of a page; the next page starts after it
+// in (Key, _id) order, where Key is the time field the listing is ordered
+// by. Key and Sort are kept so a cursor cannot be reused with another order.
+type PostCursor struct {
+	Time int64              `json:"t"`
+	ID   primitive.ObjectID `json:"id"`
+	Key  string             `json:"k,omitempty"`
+	Sort string             `json:"s"`
+}
+
+// PostPage is the envelope of every post listing. NextCursor is null on the
+// last page.
+type PostPage struct {
+	Items      []Post  `json:"items"`
+	NextCursor *string `json:"nextCursor"`
+}
+
+// Encode returns the cursor in the opaque form handed to clients.
+func (c *PostCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodePostCursor reads a cursor made by Encode.
+func DecodePostCursor(s string) (*PostCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c PostCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.ID.IsZero() {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// orderKey is the time field a listing is ordered and bounded by: the
+// publication time for published posts, so a post written long ago and
+// published today comes first, and the creation time otherwise.
+func (q PostQuery) orderKey() string {
+	if q.Status == StatusPublished {
+		return "publishedAt"
+	}
+	return "createdAt"
+}
+
+// parsePostQuery reads limit, cursor, sort, author, tag, from and to (RFC
+// 3339) from the query string.
+func parsePostQuery(r *http.Request) (PostQuery, error) {
+	params := r.URL.Query()
+	q := PostQuery{
+		Author: strings.TrimSpace(params.Get("author")),
+		Tag:    strings.ToLower(strings.TrimSpace(params.Get("tag"))),
+		Sort:   params.Get("sort"),
+		Limit:  defaultPageSize,
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || n < 1 {
+			return q, errors.New("limit must be a positive number")
+		}
+		if n > maxPageSize {
+			n = maxPageSize
+		}
+		q.Limit = n
+	}
+
+	switch q.Sort {
+	case "":
+		q.Sort = SortNewest
+	case SortNewest, SortOldest:
+	default:
+		return q, errors.New("sort must be newest or oldest")
+	}
+
+	for key, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if value := params.Get(key); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return q, errors.New(key + " must be an RFC 3339 time")
+			}
+			*t = parsed
+		}
+	}
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		c, err := DecodePostCursor(cursor)
+		if err != nil || c.Sort != q.Sort {
+			return q, ErrInvalidCursor
+		}
+		q.Cursor = c
+	}
+	return q, nil
+}
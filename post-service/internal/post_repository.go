@@ -3,6 +3,8 @@ package internal
 import (
 	"context"
 	"errors"
+	"regexp"
+	"strconv"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -16,6 +18,16 @@ const (
 	collectionName = "posts"
 )
 
+// slugAttempts bounds how often a write is retried after losing a slug to a
+// concurrent one.
+const slugAttempts = 5
+
+var (
+	ErrPostNotFound = errors.New("post not found")
+	ErrSlugConflict = errors.New("could not find a free slug, try again")
+	ErrPostNotDraft = errors.New("only drafts can be scheduled")
+)
+
 type PostRepository struct {
 	collection *mongo.Collection
 }
@@ -27,33 +39,117 @@ func NewPostRepository() *PostRepository {
 	}
 }
 
-// CreatePost creates a new post in the database
+// CreatePost creates a new post in the database and gives it a slug that
+// no other post uses.
 func (r *PostRepository) CreatePost(ctx context.Context, post *Post) error {
-	post.CreatedAt = time.Now()
-	_, err := r.collection.InsertOne(ctx, post)
-	if err != nil {
-		return err
+	post.ID = primitive.NewObjectID()
+	post.PreviousSlugs = nil
+	post.CreatedAt = clock.Now()
+
+	// Two posts with the same title can race for a slug; the loser tries the
+	// next one.
+	for attempt := 0; attempt < slugAttempts; attempt++ {
+		slug, err := r.uniqueSlug(ctx, post.Title, post.ID)
+		if err != nil {
+			return err
+		}
+		post.Slug = slug
+		_, err = r.collection.InsertOne(ctx, post)
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
 	}
-	return nil
+	return ErrSlugConflict
 }
 
-// GetAllPosts retrieves all posts from the database
-func (r *PostRepository) GetAllPosts(ctx context.Context) ([]Post, error) {
-	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
-	cursor, err := r.collection.Find(ctx, bson.M{}, opts)
+// ListPosts returns one page of posts matching q, in (orderKey, _id) order.
+func (r *PostRepository) ListPosts(ctx context.Context, q PostQuery) (*PostPage, error) {
+	key := q.orderKey()
+	conditions := []bson.M{}
+	if q.Status != "" {
+		conditions = append(conditions, bson.M{"status": q.Status})
+	}
+	if q.Member != "" {
+		conditions = append(conditions, bson.M{"$or": []bson.M{{"author": q.Member}, {"coAuthors": q.Member}}})
+	}
+	if q.Author != "" {
+		conditions = append(conditions, bson.M{"author": q.Author})
+	}
+	if q.Tag != "" {
+		conditions = append(conditions, bson.M{"tags": q.Tag})
+	}
+	if q.Search != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(q.Search), Options: "i"}
+		conditions = append(conditions, bson.M{"$or": []bson.M{
+			{"title": bson.M{"$regex": pattern}},
+			{"content": bson.M{"$regex": pattern}},
+		}})
+	}
+	between := bson.M{}
+	if !q.From.IsZero() {
+		between["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		between["$lt"] = q.To
+	}
+	if len(between) > 0 {
+		conditions = append(conditions, bson.M{key: between})
+	}
+
+	direction, after := -1, "$lt"
+	if q.Sort == SortOldest {
+		direction, after = 1, "$gt"
+	}
+	if q.Cursor != nil {
+		// Cursors from before Key was recorded are all by creation time.
+		if cursorKey := q.Cursor.Key; cursorKey != key && !(cursorKey == "" && key == "createdAt") {
+			return nil, ErrInvalidCursor
+		}
+		t := time.UnixMilli(q.Cursor.Time)
+		conditions = append(conditions, bson.M{"$or": []bson.M{
+			{key: bson.M{after: t}},
+			{key: t, "_id": bson.M{after: q.Cursor.ID}},
+		}})
+	}
+
+	filter := bson.M{}
+	if len(conditions) > 0 {
+		filter["$and"] = conditions
+	}
+
+	// One extra post tells whether there is a next page.
+	opts := options.Find().
+		SetSort(bson.D{{Key: key, Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(q.Limit + 1)
+	cursor, err := r.collection.Find(ctx, filter, opts)
 	if err != nil {
 		return nil, err
 	}
 	defer cursor.Close(ctx)
 
-	var posts []Post
-	if err = cursor.All(ctx, &posts); err != nil {
-		return nil, err
+	page := &PostPage{Items: make([]Post, 0, q.Limit)}
+	for cursor.Next(ctx) {
+		if int64(len(page.Items)) == q.Limit {
+			last := page.Items[len(page.Items)-1]
+			t := last.CreatedAt
+			if key == "publishedAt" && last.PublishedAt != nil {
+				t = *last.PublishedAt
+			}
+			next := (&PostCursor{Time: t.UnixMilli(), ID: last.ID, Key: key, Sort: q.Sort}).Encode()
+			page.NextCursor = &next
+			break
+		}
+		var post Post
+		if err := cursor.Decode(&post); err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, post)
 	}
-	return posts, nil
+	return page, cursor.Err()
 }
 
-// GetPostsByAuthor retrieves all posts by a specific author
+// GetPostsByAuthor retrieves all posts by a specific author, for data
+// exports; listings use ListPosts.
 func (r *PostRepository) GetPostsByAuthor(ctx context.Context, author string) ([]Post, error) {
 	cursor, err := r.collection.Find(ctx, bson.M{"author": author})
 	if err != nil {
@@ -68,52 +164,271 @@ func (r *PostRepository) GetPostsByAuthor(ctx context.Context, author string) ([
 	return posts, nil
 }
 
-// UpdatePost updates an existing post
-func (r *PostRepository) UpdatePost(ctx context.Context, title string, post *Post) error {
-	result, err := r.collection.UpdateOne(
-		ctx,
-		bson.M{"title": title},
-		bson.M{"$set": post},
-	)
+// GetPostByID retrieves a single post by its ID
+func (r *PostRepository) GetPostByID(ctx context.Context, id primitive.ObjectID) (*Post, error) {
+	return r.findPost(ctx, bson.M{"_id": id})
+}
+
+// GetPostBySlug retrieves the post whose current or an earlier slug is slug.
+// Callers compare the result's Slug with slug to tell the two apart.
+func (r *PostRepository) GetPostBySlug(ctx context.Context, slug string) (*Post, error) {
+	post, err := r.findPost(ctx, bson.M{"slug": slug})
+	if err == ErrPostNotFound {
+		return r.findPost(ctx, bson.M{"previousSlugs": slug})
+	}
+	return post, err
+}
+
+func (r *PostRepository) findPost(ctx context.Context, filter bson.M) (*Post, error) {
+	var post Post
+	err := r.collection.FindOne(ctx, filter).Decode(&post)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPostNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+// slugTaken reports whether slug is the current or an earlier slug of any
+// post other than id.
+func (r *PostRepository) slugTaken(ctx context.Context, slug string, id primitive.ObjectID) (bool, error) {
+	count, err := r.collection.CountDocuments(ctx, bson.M{
+		"_id": bson.M{"$ne": id},
+		"$or": []bson.M{{"slug": slug}, {"previousSlugs": slug}},
+	}, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+// uniqueSlug returns the slug for title, numbered "-2", "-3" and so on when
+// another post has it already.
+func (r *PostRepository) uniqueSlug(ctx context.Context, title string, id primitive.ObjectID) (string, error) {
+	base := Slugify(title)
+	for i := 1; ; i++ {
+		slug := base
+		if i > 1 {
+			slug = base + "-" + strconv.Itoa(i)
+		}
+		taken, err := r.slugTaken(ctx, slug, id)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return slug, nil
+		}
+	}
+}
+
+// UpdatePost applies update to the post with the given ID. A new title gives
+// the post a new slug; the old one keeps redirecting.
+func (r *PostRepository) UpdatePost(ctx context.Context, id primitive.ObjectID, update PostUpdate) error {
+	for attempt := 0; attempt < slugAttempts; attempt++ {
+		current, err := r.GetPostByID(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		set := bson.M{}
+		if update.Content != nil {
+			set["content"] = *update.Content
+		}
+		if update.Tags != nil {
+			set["tags"] = *update.Tags
+		}
+		if update.CoAuthors != nil {
+			set["coAuthors"] = *update.CoAuthors
+		}
+		if update.Title != nil {
+			set["title"] = *update.Title
+		}
+		if update.Title != nil && Slugify(*update.Title) != Slugify(current.Title) {
+			slug, err := r.uniqueSlug(ctx, *update.Title, id)
+			if err != nil {
+				return err
+			}
+			if slug != current.Slug {
+				previous := []string{}
+				for _, old := range current.PreviousSlugs {
+					if old != slug {
+						previous = append(previous, old)
+					}
+				}
+				previous = append(previous, current.Slug)
+				set["slug"] = slug
+				set["previousSlugs"] = previous
+			}
+		}
+
+		// Matching the slug we started from makes a concurrent rename of the
+		// same post start over instead of losing one of the old slugs.
+		result, err := r.collection.UpdateOne(ctx,
+			bson.M{"_id": id, "slug": current.Slug},
+			bson.M{"$set": set},
+		)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount > 0 {
+			return nil
+		}
+	}
+	return ErrSlugConflict
+}
+
+// SetPostStatus moves the post with the given ID to status and cancels any
+// scheduled publication. Publishing stamps publishedAt the first time only,
+// so republishing an unpublished post keeps its original date.
+func (r *PostRepository) SetPostStatus(ctx context.Context, id primitive.ObjectID, status string) error {
+	set := bson.M{"status": status}
+	if status == StatusPublished {
+		set["publishedAt"] = bson.M{"$ifNull": bson.A{"$publishedAt", clock.Now()}}
+	}
+	result, err := r.collection.UpdateOne(ctx, bson.M{"_id": id},
+		bson.A{bson.M{"$set": set}, bson.M{"$unset": "scheduledAt"}})
 	if err != nil {
 		return err
 	}
 	if result.MatchedCount == 0 {
-		return errors.New("post not found")
+		return ErrPostNotFound
 	}
 	return nil
 }
 
-// DeletePost deletes a post by its title
-func (r *PostRepository) DeletePost(ctx context.Context, title string) error {
-	result, err := r.collection.DeleteOne(ctx, bson.M{"title": title})
+// SchedulePost sets the time at which the draft with the given ID is
+// published, replacing an earlier schedule. Posts that are not drafts give
+// ErrPostNotDraft.
+func (r *PostRepository) SchedulePost(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	result, err := r.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "status": StatusDraft},
+		bson.M{"$set": bson.M{"scheduledAt": at}},
+	)
 	if err != nil {
 		return err
 	}
-	if result.DeletedCount == 0 {
-		return errors.New("post not found")
+	if result.MatchedCount == 0 {
+		if _, err := r.GetPostByID(ctx, id); err != nil {
+			return err
+		}
+		return ErrPostNotDraft
 	}
 	return nil
 }
 
-// SearchPosts searches for posts based on title or content
-func (r *PostRepository) SearchPosts(ctx context.Context, query string) ([]Post, error) {
-	filter := bson.M{
-		"$or": []bson.M{
-			{"title": bson.M{"$regex": primitive.Regex{Pattern: query, Options: "i"}}},
-			{"content": bson.M{"$regex": primitive.Regex{Pattern: query, Options: "i"}}},
+// PublishDuePost publishes one draft whose scheduledAt is not after now and
+// returns it, or ErrPostNotFound if none is due. Finding and publishing the
+// post is a single atomic update, so concurrent callers never publish the
+// same post twice. The post counts as published at the time it was
+// scheduled for, not when the scheduler got to it.
+func (r *PostRepository) PublishDuePost(ctx context.Context, now time.Time) (*Post, error) {
+	var post Post
+	err := r.collection.FindOneAndUpdate(ctx,
+		bson.M{"status": StatusDraft, "scheduledAt": bson.M{"$lte": now}},
+		bson.A{
+			bson.M{"$set": bson.M{
+				"status":      StatusPublished,
+				"publishedAt": bson.M{"$ifNull": bson.A{"$publishedAt", "$scheduledAt"}},
+			}},
+			bson.M{"$unset": "scheduledAt"},
 		},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "scheduledAt", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&post)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPostNotFound
 	}
-	
-	cursor, err := r.collection.Find(ctx, filter)
 	if err != nil {
 		return nil, err
 	}
+	return &post, nil
+}
+
+// DeletePost deletes a post by its ID
+func (r *PostRepository) DeletePost(ctx context.Context, id primitive.ObjectID) error {
+	result, err := r.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrPostNotFound
+	}
+	return nil
+}
+
+// BackfillStatus marks posts written before drafts existed as published,
+// as they have always been public. It is safe to run on every start.
+func (r *PostRepository) BackfillStatus(ctx context.Context) error {
+	_, err := r.collection.UpdateMany(ctx,
+		bson.M{"status": bson.M{"$exists": false}},
+		bson.A{bson.M{"$set": bson.M{"status": StatusPublished, "publishedAt": "$createdAt"}}},
+	)
+	return err
+}
+
+// BackfillSlugs gives posts written before slugs existed one. It is safe to
+// run on every start.
+func (r *PostRepository) BackfillSlugs(ctx context.Context) error {
+	cursor, err := r.collection.Find(ctx, bson.M{"slug": bson.M{"$not": bson.M{"$type": "string"}}})
+	if err != nil {
+		return err
+	}
 	defer cursor.Close(ctx)
 
-	var posts []Post
-	if err = cursor.All(ctx, &posts); err != nil {
-		return nil, err
+	for cursor.Next(ctx) {
+		var post Post
+		if err := cursor.Decode(&post); err != nil {
+			return err
+		}
+		slug, err := r.uniqueSlug(ctx, post.Title, post.ID)
+		if err != nil {
+			return err
+		}
+		_, err = r.collection.UpdateOne(ctx,
+			bson.M{"_id": post.ID, "slug": bson.M{"$not": bson.M{"$type": "string"}}},
+			bson.M{"$set": bson.M{"slug": slug}},
+		)
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
 	}
-	return posts, nil
-} 
\ No newline at end of file
+	return cursor.Err()
+}
+
+// RenameAuthor moves every post of oldUsername to newUsername, as author and
+// as co-author.
+func (r *PostRepository) RenameAuthor(ctx context.Context, oldUsername, newUsername string) error {
+	_, err := r.collection.UpdateMany(ctx, bson.M{"author": oldUsername}, bson.M{"$set": bson.M{"author": newUsername}})
+	if err != nil {
+		return err
+	}
+	_, err = r.collection.UpdateMany(ctx,
+		bson.M{"coAuthors": oldUsername},
+		bson.M{"$set": bson.M{"coAuthors.$[name]": newUsername}},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"name": oldUsername}}}),
+	)
+	return err
+}
+
+// RemoveCoAuthor takes username off every post it co-authors and returns
+// how many posts were changed.
+func (r *PostRepository) RemoveCoAuthor(ctx context.Context, username string) (int64, error) {
+	result, err := r.collection.UpdateMany(ctx, bson.M{"coAuthors": username}, bson.M{"$pull": bson.M{"coAuthors": username}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// DeletePostsByAuthor removes every post of author and returns how many
+// were removed.
+func (r *PostRepository) DeletePostsByAuthor(ctx context.Context, author string) (int64, error) {
+	result, err := r.collection.DeleteMany(ctx, bson.M{"author": author})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
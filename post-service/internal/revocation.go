@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Access tokens carry iat in milliseconds, so that a token issued in the
+// same second as a revocation of its user, but after it, stays valid.
+func init() {
+	jwt.TimePrecision = time.Millisecond
+}
+
+// revocationOverlap is subtracted from the last sync time so that entries
+// written while a poll was in flight are not missed.
+const revocationOverlap = 5 * time.Second
+
+type revocation struct {
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`
+	RevokedAt time.Time `json:"revokedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// denyList is an in-memory copy of auth-service's revocation list. It is
+// refreshed in the background so that AuthMiddleware never has to make a
+// network call to decide whether a token was revoked.
+type denyList struct {
+	mu       sync.RWMutex
+	entries  map[string]revocation
+	lastSync time.Time
+}
+
+var revokedTokens = &denyList{entries: make(map[string]revocation)}
+
+func getAuthServiceURL() string {
+	if os.Getenv("ENVIRONMENT") == "production" {
+		return "http://auth-service:81"
+	}
+
+	if uri := os.Getenv("AUTH_SERVICE_URL"); uri != "" {
+		return uri
+	}
+
+	return "http://localhost:8081"
+}
+
+// getServiceAPIKey returns the shared secret that auth-service asks for on
+// /revocations and /tokens/introspect; outside production it defaults to
+// auth-service's development key.
+func getServiceAPIKey() string {
+	if key := os.Getenv("SERVICE_API_KEY"); key != "" {
+		return key
+	}
+	if os.Getenv("ENVIRONMENT") == "production" {
+		return ""
+	}
+	return "dev-service-api-key"
+}
+
+// StartRevocationSync loads the deny-list and keeps polling auth-service for
+// new revocations every REVOCATION_SYNC_INTERVAL (default 10s).
+func StartRevocationSync() {
+	interval := 10 * time.Second
+	if v, err := time.ParseDuration(os.Getenv("REVOCATION_SYNC_INTERVAL")); err == nil && v > 0 {
+		interval = v
+	}
+
+	if err := revokedTokens.sync(); err != nil {
+		log.Printf("Initial revocation sync failed: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := revokedTokens.sync(); err != nil {
+				log.Printf("Revocation sync failed: %v", err)
+			}
+		}
+	}()
+}
+
+func (d *denyList) sync() error {
+	d.mu.RLock()
+	since := d.lastSync
+	d.mu.RUnlock()
+
+	endpoint := getAuthServiceURL() + "/revocations"
+	if !since.IsZero() {
+		endpoint += "?since=" + url.QueryEscape(since.Add(-revocationOverlap).Format(time.RFC3339Nano))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+getServiceAPIKey())
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from auth-service: %s", resp.Status)
+	}
+
+	var body struct {
+		Revocations []revocation `json:"revocations"`
+		Now         time.Time    `json:"now"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, rev := range body.Revocations {
+		d.entries[rev.Kind+":"+rev.Value] = rev
+	}
+	for key, rev := range d.entries {
+		if now.After(rev.ExpiresAt) {
+			delete(d.entries, key)
+		}
+	}
+	d.lastSync = body.Now
+	return nil
+}
+
+func (d *denyList) get(kind, value string) (revocation, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	rev, ok := d.entries[kind+":"+value]
+	return rev, ok
+}
+
+// IsTokenRevoked reports whether the token described by claims is on the
+// deny-list, either by its own jti, by the login session ("sid") it belongs
+// to, or because every token of its user issued before a given time was
+// revoked (for example after a password reset).
+func IsTokenRevoked(claims jwt.MapClaims) bool {
+	if jti, ok := claims["jti"].(string); ok {
+		if _, found := revokedTokens.get("token", jti); found {
+			return true
+		}
+	}
+
+	if sid, ok := claims["sid"].(string); ok {
+		if _, found := revokedTokens.get("session", sid); found {
+			return true
+		}
+	}
+
+	if username, ok := claims["username"].(string); ok {
+		if rev, found := revokedTokens.get("user", username); found {
+			iat, err := claims.GetIssuedAt()
+			if err != nil || iat == nil || !iat.After(rev.RevokedAt.Truncate(time.Millisecond)) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// Clock tells the scheduler what time it is, so tests can move time along
+// without waiting for it.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// clock is the time used for scheduling decisions.
+var clock Clock = systemClock{}
+
+// duePostPublisher publishes one due post at a time; PostRepository is the
+// real one.
+type duePostPublisher interface {
+	PublishDuePost(ctx context.Context, now time.Time) (*Post, error)
+}
+
+// Scheduler publishes drafts whose scheduledAt has come. Each post is
+// claimed and published in a single findOneAndUpdate, so several replicas
+// can run a scheduler side by side without publishing a post twice, and
+// nothing is lost if a replica stops: the due posts are still drafts with a
+// scheduledAt in the past and the next pass, on any replica, picks them up.
+type Scheduler struct {
+	repo  duePostPublisher
+	clock Clock
+}
+
+// NewScheduler returns a scheduler that publishes through repo, reading the
+// time from clock.
+func NewScheduler(repo duePostPublisher, clock Clock) *Scheduler {
+	return &Scheduler{repo: repo, clock: clock}
+}
+
+// RunOnce publishes every post that is due and returns how many it
+// published.
+func (s *Scheduler) RunOnce(ctx context.Context) (int, error) {
+	published := 0
+	for {
+		post, err := s.repo.PublishDuePost(ctx, s.clock.Now())
+		if err == ErrPostNotFound {
+			return published, nil
+		}
+		if err != nil {
+			return published, err
+		}
+		log.Printf("Published scheduled post %s (%s)", post.ID.Hex(), post.Slug)
+		published++
+	}
+}
+
+// Start publishes posts that came due while no replica was running before
+// returning, then checks for due posts every interval until ctx is done.
+func (s *Scheduler) Start(ctx context.Context, interval time.Duration) {
+	run := func() {
+		runCtx, cancel := context.WithTimeout(ctx, interval)
+		defer cancel()
+		if _, err := s.RunOnce(runCtx); err != nil {
+			log.Printf("Scheduled publishing failed: %v", err)
+		}
+	}
+
+	run()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				run()
+			}
+		}
+	}()
+}
+
+// StartScheduler starts the scheduler with PUBLISH_SCHEDULER_INTERVAL
+// (default 30s) between checks.
+func StartScheduler() {
+	initializeRepo()
+
+	interval := 30 * time.Second
+	if v, err := time.ParseDuration(os.Getenv("PUBLISH_SCHEDULER_INTERVAL")); err == nil && v > 0 {
+		interval = v
+	}
+
+	NewScheduler(postRepo, clock).Start(context.Background(), interval)
+}
@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fakeClock is a Clock that only moves when the test moves it.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// memoryPosts keeps posts in memory and publishes due ones the way
+// PostRepository.PublishDuePost does: one post per call, claimed and
+// published under a single lock.
+type memoryPosts struct {
+	mu    sync.Mutex
+	posts []*Post
+}
+
+func (m *memoryPosts) PublishDuePost(ctx context.Context, now time.Time) (*Post, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.posts {
+		if p.Status == StatusDraft && p.ScheduledAt != nil && !p.ScheduledAt.After(now) {
+			p.Status = StatusPublished
+			if p.PublishedAt == nil {
+				p.PublishedAt = p.ScheduledAt
+			}
+			p.ScheduledAt = nil
+			published := *p
+			return &published, nil
+		}
+	}
+	return nil, ErrPostNotFound
+}
+
+func (m *memoryPosts) get(id primitive.ObjectID) *Post {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.posts {
+		if p.ID == id {
+			copied := *p
+			return &copied
+		}
+	}
+	return nil
+}
+
+// postStore is what the scheduler tests need from a store of posts.
+type postStore interface {
+	duePostPublisher
+	add(t *testing.T, post *Post)
+	get(id primitive.ObjectID) *Post
+}
+
+func (m *memoryPosts) add(t *testing.T, post *Post) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.posts = append(m.posts, post)
+}
+
+// mongoPosts runs the tests against PostRepository in a throwaway
+// database.
+type mongoPosts struct {
+	*PostRepository
+	t *testing.T
+}
+
+func (m *mongoPosts) add(t *testing.T, post *Post) {
+	if _, err := m.collection.InsertOne(context.Background(), post); err != nil {
+		t.Fatalf("insert post: %v", err)
+	}
+}
+
+func (m *mongoPosts) get(id primitive.ObjectID) *Post {
+	post, err := m.GetPostByID(context.Background(), id)
+	if err != nil {
+		m.t.Fatalf("get post: %v", err)
+	}
+	return post
+}
+
+// forEachStore runs test against the in-memory store and, if MONGO_TEST_URI
+// is set, against MongoDB.
+func forEachStore(t *testing.T, test func(t *testing.T, store postStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, &memoryPosts{})
+	})
+	t.Run("mongo", func(t *testing.T) {
+		test(t, mongoStore(t))
+	})
+}
+
+// mongoStore returns a store in a throwaway MongoDB database at
+// MONGO_TEST_URI and skips the test if it is not set.
+func mongoStore(t *testing.T) postStore {
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	db := client.Database("blogdb_test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return &mongoPosts{PostRepository: &PostRepository{collection: db.Collection(collectionName)}, t: t}
+}
+
+var scheduleTime = time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+
+func scheduledDraft(at time.Time) *Post {
+	return &Post{
+		ID:          primitive.NewObjectID(),
+		Slug:        "post-" + primitive.NewObjectID().Hex(),
+		Title:       "Scheduled",
+		Author:      "alice",
+		Status:      StatusDraft,
+		CreatedAt:   at.Add(-48 * time.Hour),
+		ScheduledAt: &at,
+	}
+}
+
+func runOnce(t *testing.T, s *Scheduler) int {
+	t.Helper()
+	n, err := s.RunOnce(context.Background())
+	if err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	return n
+}
+
+func TestSchedulerWaitsUntilScheduledTime(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store postStore) {
+		post := scheduledDraft(scheduleTime)
+		store.add(t, post)
+		clock := &fakeClock{now: scheduleTime.Add(-time.Millisecond)}
+
+		if n := runOnce(t, NewScheduler(store, clock)); n != 0 {
+			t.Fatalf("published %d posts before they were due", n)
+		}
+		if got := store.get(post.ID); got.Status != StatusDraft || got.ScheduledAt == nil {
+			t.Fatalf("post is %s, scheduledAt %v; want a scheduled draft", got.Status, got.ScheduledAt)
+		}
+	})
+}
+
+func TestSchedulerPublishesAtScheduledTime(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store postStore) {
+		post := scheduledDraft(scheduleTime)
+		store.add(t, post)
+		clock := &fakeClock{now: scheduleTime}
+
+		if n := runOnce(t, NewScheduler(store, clock)); n != 1 {
+			t.Fatalf("published %d posts, want 1", n)
+		}
+		got := store.get(post.ID)
+		if got.Status != StatusPublished {
+			t.Fatalf("status = %s, want %s", got.Status, StatusPublished)
+		}
+		if got.PublishedAt == nil || !got.PublishedAt.Equal(scheduleTime) {
+			t.Fatalf("publishedAt = %v, want %v", got.PublishedAt, scheduleTime)
+		}
+		if got.ScheduledAt != nil {
+			t.Fatalf("scheduledAt = %v, want it cleared", got.ScheduledAt)
+		}
+	})
+}
+
+// TestSchedulerPublishesOnlyOnce checks the atomic claim in
+// PostRepository.PublishDuePost, so it only runs against MongoDB: the
+// in-memory store would pass whatever the real query does.
+func TestSchedulerPublishesOnlyOnce(t *testing.T) {
+	store := mongoStore(t)
+	for i := 0; i < 20; i++ {
+		store.add(t, scheduledDraft(scheduleTime.Add(time.Duration(i)*time.Minute)))
+	}
+	clock := &fakeClock{now: scheduleTime.Add(time.Hour)}
+
+	// Several replicas pass over the same posts at the same time.
+	const replicas = 4
+	counts := make([]int, replicas)
+	var wg sync.WaitGroup
+	for i := 0; i < replicas; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n, err := NewScheduler(store, clock).RunOnce(context.Background())
+			if err != nil {
+				t.Errorf("RunOnce: %v", err)
+			}
+			counts[i] = n
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if total != 20 {
+		t.Fatalf("replicas published %d posts between them, want 20", total)
+	}
+	if n := runOnce(t, NewScheduler(store, clock)); n != 0 {
+		t.Fatalf("second pass published %d posts again", n)
+	}
+}
+
+func TestSchedulerCatchesUpOnStart(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store postStore) {
+		missed := scheduledDraft(scheduleTime)
+		later := scheduledDraft(scheduleTime.Add(24 * time.Hour))
+		store.add(t, missed)
+		store.add(t, later)
+
+		// The service was down at scheduleTime and comes back an hour late.
+		clock := &fakeClock{now: scheduleTime.Add(time.Hour)}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		NewScheduler(store, clock).Start(ctx, time.Hour)
+
+		got := store.get(missed.ID)
+		if got.Status != StatusPublished {
+			t.Fatalf("missed post is %s after start, want %s", got.Status, StatusPublished)
+		}
+		if got.PublishedAt == nil || !got.PublishedAt.Equal(scheduleTime) {
+			t.Fatalf("publishedAt = %v, want %v", got.PublishedAt, scheduleTime)
+		}
+		if got := store.get(later.ID); got.Status != StatusDraft {
+			t.Fatalf("post due tomorrow is %s, want %s", got.Status, StatusDraft)
+		}
+	})
+}
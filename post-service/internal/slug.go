@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"strings"
+	"unicode"
+)
+
+// maxSlugLength keeps URLs readable; longer titles are cut at a word
+// boundary where possible.
+const maxSlugLength = 80
+
+// turkishReplacer spells Turkish letters with their closest ASCII letter, so
+// "Güzel Şehirler" becomes "guzel-sehirler" rather than "g-zel-ehirler".
+var turkishReplacer = strings.NewReplacer(
+	"ç", "c", "Ç", "c",
+	"ğ", "g", "Ğ", "g",
+	"ı", "i", "İ", "i",
+	"ö", "o", "Ö", "o",
+	"ş", "s", "Ş", "s",
+	"ü", "u", "Ü", "u",
+	"â", "a", "Â", "a",
+	"î", "i", "Î", "i",
+	"û", "u", "Û", "u",
+)
+
+// Slugify turns a post title into the lower-case, hyphen separated form used
+// in URLs. Titles without any usable letters or digits give "post".
+func Slugify(title string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range turkishReplacer.Replace(title) {
+		r = unicode.ToLower(r)
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+			continue
+		}
+		hyphen = true
+	}
+
+	slug := b.String()
+	if len(slug) > maxSlugLength {
+		slug = slug[:maxSlugLength]
+		if i := strings.LastIndexByte(slug, '-'); i > maxSlugLength/2 {
+			slug = slug[:i]
+		}
+		slug = strings.TrimRight(slug, "-")
+	}
+	if slug == "" {
+		return "post"
+	}
+	return slug
+}
@@ -19,6 +19,7 @@ docker build -t post-service:latest .
 cd ../kubernetes
 # MongoDB ve diğer bağımlılıkları başlat
 kubectl apply -f postgres-secret.yaml
+kubectl apply -f service-api-key-secret.yaml
 kubectl apply -f postgres-pv-pvc.yaml
 kubectl apply -f postgres-deployment.yaml
 kubectl apply -f postgres-service.yaml
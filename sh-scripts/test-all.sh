@@ -19,7 +19,8 @@ REGISTER_RESPONSE=$(curl -s -X POST "$AUTH_URL/register" \
   -H "Content-Type: application/json" \
   -d '{
     "username": "testuser",
-    "password": "testpass123"
+    "password": "testpass123",
+    "email": "test@example.com"
   }')
 echo "Register Response: $REGISTER_RESPONSE"
 
@@ -53,9 +54,11 @@ CREATE_RESPONSE=$(curl -s -X POST "$POST_URL/posts" \
   -d '{
     "title": "Test Başlık",
     "content": "Test İçerik",
-    "author": "testuser"
+    "status": "published"
   }')
 echo "Create Response: $CREATE_RESPONSE"
+POST_ID=$(echo $CREATE_RESPONSE | grep -o '"id":"[^"]*' | grep -o '[^"]*$')
+POST_SLUG=$(echo $CREATE_RESPONSE | grep -o '"slug":"[^"]*' | grep -o '[^"]*$')
 
 sleep 1
 
@@ -68,22 +71,24 @@ AUTHOR_RESPONSE=$(curl -s -X GET "$POST_URL/posts/author?author=testuser")
 echo "Author Posts Response: $AUTHOR_RESPONSE"
 
 echo -e "\n${GREEN}2.4. Updating the post...${NC}"
-UPDATE_RESPONSE=$(curl -s -X PUT "$POST_URL/posts/manage?title=Test%20Başlık" \
+UPDATE_RESPONSE=$(curl -s -X PUT "$POST_URL/posts/$POST_ID" \
   -H "Content-Type: application/json" \
   -H "Authorization: Bearer $TOKEN" \
   -d '{
-    "title": "Test Başlık",
+    "title": "Yeni Başlık",
     "content": "Güncellenmiş İçerik",
     "author": "testuser"
   }')
 echo "Update Response: $UPDATE_RESPONSE"
 
 echo -e "\n${GREEN}2.5. Verifying the update...${NC}"
-VERIFY_RESPONSE=$(curl -s -X GET "$POST_URL/posts/author?author=testuser")
+VERIFY_RESPONSE=$(curl -s -X GET "$POST_URL/posts/$POST_ID")
 echo "Verify Response: $VERIFY_RESPONSE"
+REDIRECT=$(curl -s -o /dev/null -w '%{http_code} %{redirect_url}' "$POST_URL/posts/by-slug/$POST_SLUG")
+echo "Old slug $POST_SLUG: $REDIRECT"
 
 echo -e "\n${GREEN}2.6. Deleting the post...${NC}"
-DELETE_RESPONSE=$(curl -s -X DELETE "$POST_URL/posts/manage?title=Test%20Başlık" \
+DELETE_RESPONSE=$(curl -s -X DELETE "$POST_URL/posts/$POST_ID" \
   -H "Authorization: Bearer $TOKEN")
 echo "Delete Response: $DELETE_RESPONSE"
 
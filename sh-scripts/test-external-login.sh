@@ -0,0 +1,168 @@
+#!/bin/bash
+
+# End-to-end test of signing in with an external OpenID Connect provider,
+# using auth-service/cmd/mockidp as the provider. The script plays the
+# browser: it follows the redirects and tells the mock provider who signs in.
+# Needs a running MongoDB, curl, jq and mongosh. Start the mock provider and
+# auth-service first:
+#
+#   go run ./cmd/mockidp &
+#   OIDC_PROVIDERS='[{"name":"mock","display_name":"Mock","issuer":"http://localhost:9998",
+#     "client_id":"auth-service","client_secret":"mock-secret"}]' go run ./cmd
+
+GREEN='\033[0;32m'
+RED='\033[0;31m'
+NC='\033[0m'
+
+AUTH_URL=${AUTH_URL:-"http://localhost:8081"}
+MONGO_URI=${MONGO_URI:-"mongodb://localhost:27017"}
+PROVIDER="mock"
+
+USER="extuser"
+USER_PASS="ext-user-pass-1"
+USER_EMAIL="extuser@example.com"
+RUN=$(date +%s)
+
+FAILED=0
+
+check() {
+    local description=$1
+    local condition=$2
+    if [ "$condition" = "true" ]; then
+        echo -e "${GREEN}✓${NC} ${description}"
+    else
+        echo -e "${RED}✗${NC} ${description}"
+        FAILED=1
+    fi
+}
+
+query_param() {
+    echo "$1" | sed -n "s/.*[?&]$2=\([^&]*\).*/\1/p"
+}
+
+redirect_of() {
+    curl -s -o /dev/null -w '%{redirect_url}' "$1"
+}
+
+# provider_round_trip takes the provider URL auth-service sent the browser to,
+# signs in there as the given subject and email, and prints where the
+# callback sends the browser next.
+provider_round_trip() {
+    local authorize_url=$1 sub=$2 email=$3 verified=${4:-true}
+    local callback=$(curl -s -o /dev/null -w '%{redirect_url}' -G "$authorize_url" \
+        --data-urlencode "sub=$sub" \
+        --data-urlencode "email=$email" \
+        --data-urlencode "email_verified=$verified")
+    redirect_of "$callback"
+}
+
+# external_login signs in through the provider and prints the final redirect.
+external_login() {
+    provider_round_trip "$(redirect_of "$AUTH_URL/login/external/$PROVIDER")" "$@"
+}
+
+exchange() {
+    curl -s -X POST -H "Content-Type: application/json" \
+        -d "{\"code\":\"$1\"}" "$AUTH_URL/login/external/exchange"
+}
+
+me() {
+    curl -s -H "Authorization: Bearer $1" "$AUTH_URL/users/me"
+}
+
+# confirm_link finishes a link with the link_code from the landing page and
+# prints the HTTP status.
+confirm_link() {
+    local token=$1 landing=$2
+    curl -s -o /dev/null -w '%{http_code}' -X POST -H "Authorization: Bearer $token" \
+        -H "Content-Type: application/json" \
+        -d "{\"code\":\"$(query_param "$landing" link_code)\"}" \
+        "$AUTH_URL/users/me/identities/$PROVIDER/confirm"
+}
+
+echo "🔗 External Login Test"
+echo "----------------------"
+
+echo -e "\n${GREEN}1. Providers${NC}"
+PROVIDERS=$(curl -s "$AUTH_URL/login/providers")
+check "the mock provider is listed" "$(echo "$PROVIDERS" | jq --arg p "$PROVIDER" 'map(.name) | index($p) != null')"
+
+echo -e "\n${GREEN}2. First sign-in creates an account${NC}"
+LANDING=$(external_login "new-$RUN" "newcomer$RUN@example.com")
+CODE=$(query_param "$LANDING" code)
+check "the browser lands on the frontend with a code" "$([ -n "$CODE" ] && echo true)"
+TOKEN=$(exchange "$CODE" | jq -r '.token')
+check "the code is traded for a token" "$([ "$TOKEN" != "null" ] && [ -n "$TOKEN" ] && echo true)"
+NEW_USER=$(me "$TOKEN" | jq -r '.username')
+check "the new account can be used" "$([ "$NEW_USER" != "null" ] && [ -n "$NEW_USER" ] && echo true)"
+STATUS=$(curl -s -o /dev/null -w '%{http_code}' -X POST -H "Content-Type: application/json" \
+    -d "{\"code\":\"$CODE\"}" "$AUTH_URL/login/external/exchange")
+check "a login code works only once" "$([ "$STATUS" = "401" ] && echo true)"
+
+LANDING=$(external_login "new-$RUN" "newcomer$RUN@example.com")
+AGAIN=$(me "$(exchange "$(query_param "$LANDING" code)" | jq -r '.token')" | jq -r '.username')
+check "signing in again finds the same account" "$([ "$AGAIN" = "$NEW_USER" ] && echo true)"
+
+STATUS=$(curl -s -o /dev/null -w '%{http_code}' -X DELETE -H "Authorization: Bearer $TOKEN" \
+    "$AUTH_URL/users/me/identities/$PROVIDER")
+check "the only sign-in method can't be unlinked" "$([ "$STATUS" = "409" ] && echo true)"
+
+echo -e "\n${GREEN}3. Matching an existing account by email${NC}"
+curl -s -X POST -H "Content-Type: application/json" \
+    -d "{\"username\":\"$USER\",\"password\":\"$USER_PASS\",\"email\":\"$USER_EMAIL\"}" \
+    "$AUTH_URL/register" > /dev/null
+mongosh --quiet "$MONGO_URI/authdb" \
+    --eval "db.users.updateOne({username: '$USER'}, {\$set: {emailVerified: false}, \$unset: {identities: ''}})" > /dev/null
+
+LANDING=$(external_login "email-$RUN" "$USER_EMAIL")
+check "an unverified local email is not taken over" "$([ "$(query_param "$LANDING" error)" = "email_taken" ] && echo true)"
+
+mongosh --quiet "$MONGO_URI/authdb" \
+    --eval "db.users.updateOne({username: '$USER'}, {\$set: {emailVerified: true}})" > /dev/null
+LANDING=$(external_login "email-$RUN" "$USER_EMAIL" false)
+check "an unverified provider email is not trusted" "$([ "$(query_param "$LANDING" error)" = "email_taken" ] && echo true)"
+LANDING=$(external_login "email-$RUN" "$USER_EMAIL")
+MATCHED=$(me "$(exchange "$(query_param "$LANDING" code)" | jq -r '.token')" | jq -r '.username')
+check "verified emails on both sides link the accounts" "$([ "$MATCHED" = "$USER" ] && echo true)"
+
+echo -e "\n${GREEN}4. Linking from settings${NC}"
+USER_TOKEN=$(curl -s -X POST -H "Content-Type: application/json" \
+    -d "{\"username\":\"$USER\",\"password\":\"$USER_PASS\"}" "$AUTH_URL/login" | jq -r '.token')
+curl -s -X DELETE -H "Authorization: Bearer $USER_TOKEN" "$AUTH_URL/users/me/identities/$PROVIDER" > /dev/null
+
+AUTHORIZE_URL=$(curl -s -X POST -H "Authorization: Bearer $USER_TOKEN" \
+    "$AUTH_URL/users/me/identities/$PROVIDER" | jq -r '.authorize_url')
+LANDING=$(provider_round_trip "$AUTHORIZE_URL" "new-$RUN" "newcomer$RUN@example.com")
+check "an identity of another user can't be linked" "$([ "$(confirm_link "$USER_TOKEN" "$LANDING")" = "409" ] && echo true)"
+
+AUTHORIZE_URL=$(curl -s -X POST -H "Authorization: Bearer $USER_TOKEN" \
+    "$AUTH_URL/users/me/identities/$PROVIDER" | jq -r '.authorize_url')
+LANDING=$(provider_round_trip "$AUTHORIZE_URL" "link-$RUN" "other$RUN@example.com")
+NEWCOMER_TOKEN=$(exchange "$(query_param "$(external_login "new-$RUN" "newcomer$RUN@example.com")" code)" | jq -r '.token')
+check "another user can't confirm the link" "$([ "$(confirm_link "$NEWCOMER_TOKEN" "$LANDING")" = "400" ] && echo true)"
+check "a password account links the provider" "$([ "$(confirm_link "$USER_TOKEN" "$LANDING")" = "200" ] && echo true)"
+IDENTITIES=$(curl -s -H "Authorization: Bearer $USER_TOKEN" "$AUTH_URL/users/me/identities")
+check "the identity is listed" "$(echo "$IDENTITIES" | jq --arg p "$PROVIDER" '.has_password and (.identities | map(.provider) | index($p) != null)')"
+
+LANDING=$(external_login "link-$RUN" "other$RUN@example.com")
+LINKED=$(me "$(exchange "$(query_param "$LANDING" code)" | jq -r '.token')" | jq -r '.username')
+check "the linked identity signs in to the password account" "$([ "$LINKED" = "$USER" ] && echo true)"
+
+STATUS=$(curl -s -o /dev/null -w '%{http_code}' -X DELETE -H "Authorization: Bearer $USER_TOKEN" \
+    "$AUTH_URL/users/me/identities/$PROVIDER")
+check "a password account can unlink the provider" "$([ "$STATUS" = "204" ] && echo true)"
+
+echo -e "\n${GREEN}5. Failures${NC}"
+LANDING=$(redirect_of "$AUTH_URL/login/external/$PROVIDER/callback?state=forged&code=abc")
+check "an unknown state is refused" "$([ "$(query_param "$LANDING" error)" = "invalid_state" ] && echo true)"
+AUTHORIZE_URL=$(redirect_of "$AUTH_URL/login/external/$PROVIDER")
+LANDING=$(redirect_of "$(redirect_of "$AUTHORIZE_URL&sub=x&deny=1")")
+check "a refusal at the provider is passed on" "$([ "$(query_param "$LANDING" error)" = "access_denied" ] && echo true)"
+STATUS=$(curl -s -o /dev/null -w '%{http_code}' "$AUTH_URL/login/external/nope")
+check "unknown providers are 404" "$([ "$STATUS" = "404" ] && echo true)"
+
+if [ $FAILED -ne 0 ]; then
+    echo -e "\n${RED}External login tests failed${NC}"
+    exit 1
+fi
+echo -e "\n${GREEN}All external login tests passed! 🎉${NC}"
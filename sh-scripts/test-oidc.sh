@@ -0,0 +1,166 @@
+#!/bin/bash
+
+# End-to-end test of auth-service's OpenID Connect provider. The script plays
+# both the relying party (a local test client on http://localhost:9999/callback)
+# and the frontend's consent page. Needs a running auth-service and MongoDB,
+# plus curl, jq, openssl and mongosh.
+
+GREEN='\033[0;32m'
+RED='\033[0;31m'
+NC='\033[0m'
+
+AUTH_URL=${AUTH_URL:-"http://localhost:8081"}
+MONGO_URI=${MONGO_URI:-"mongodb://localhost:27017"}
+REDIRECT_URI="http://localhost:9999/callback"
+
+ADMIN_USER="oidcadmin"
+ADMIN_PASS="oidc-admin-pass-1"
+USER="oidcuser"
+USER_PASS="oidc-user-pass-1"
+
+FAILED=0
+
+check() {
+    local description=$1
+    local condition=$2
+    if [ "$condition" = "true" ]; then
+        echo -e "${GREEN}✓${NC} ${description}"
+    else
+        echo -e "${RED}✗${NC} ${description}"
+        FAILED=1
+    fi
+}
+
+login() {
+    curl -s -X POST -H "Content-Type: application/json" \
+        -d "{\"username\":\"$1\",\"password\":\"$2\"}" \
+        "$AUTH_URL/login" | jq -r '.token'
+}
+
+b64url_decode() {
+    local data=$(echo -n "$1" | tr '_-' '/+')
+    while [ $(( ${#data} % 4 )) -ne 0 ]; do data="${data}="; done
+    echo -n "$data" | base64 -d 2>/dev/null
+}
+
+query_param() {
+    echo "$1" | sed -n "s/.*[?&]$2=\([^&]*\).*/\1/p"
+}
+
+echo "🔑 OIDC Provider Test"
+echo "---------------------"
+
+# Accounts: one admin to register the client, one user to sign in with.
+for account in "$ADMIN_USER:$ADMIN_PASS:oidcadmin@example.com" "$USER:$USER_PASS:oidcuser@example.com"; do
+    IFS=: read -r name pass email <<< "$account"
+    curl -s -X POST -H "Content-Type: application/json" \
+        -d "{\"username\":\"$name\",\"password\":\"$pass\",\"email\":\"$email\"}" \
+        "$AUTH_URL/register" > /dev/null
+done
+mongosh --quiet "$MONGO_URI/authdb" \
+    --eval "db.users.updateOne({username: '$ADMIN_USER'}, {\$set: {roles: ['reader', 'admin']}})" > /dev/null
+
+ADMIN_TOKEN=$(login "$ADMIN_USER" "$ADMIN_PASS")
+USER_TOKEN=$(login "$USER" "$USER_PASS")
+
+echo -e "\n${GREEN}1. Discovery${NC}"
+DISCOVERY=$(curl -s "$AUTH_URL/.well-known/openid-configuration")
+check "issuer is published" "$(echo "$DISCOVERY" | jq '.issuer != null')"
+check "S256 PKCE is advertised" "$(echo "$DISCOVERY" | jq '.code_challenge_methods_supported | index("S256") != null')"
+JWKS_URI=$(echo "$DISCOVERY" | jq -r '.jwks_uri')
+check "JWKS has keys" "$(curl -s "$JWKS_URI" | jq '.keys | length > 0')"
+
+echo -e "\n${GREEN}2. Client registration${NC}"
+CLIENT=$(curl -s -X POST -H "Authorization: Bearer $ADMIN_TOKEN" -H "Content-Type: application/json" \
+    -d "{\"name\":\"Test client\",\"redirect_uris\":[\"$REDIRECT_URI\"]}" \
+    "$AUTH_URL/admin/oauth/clients")
+CLIENT_ID=$(echo "$CLIENT" | jq -r '.client.client_id')
+CLIENT_SECRET=$(echo "$CLIENT" | jq -r '.client_secret')
+check "client created with a secret" "$([ -n "$CLIENT_ID" ] && [ "$CLIENT_SECRET" != "null" ] && echo true)"
+
+# authorize runs /oauth/authorize with a fresh PKCE pair and sets
+# REQUEST_ID to the consent request it was redirected to.
+authorize() {
+    VERIFIER=$(openssl rand -base64 48 | tr '+/' '-_' | tr -d '=\n')
+    CHALLENGE=$(echo -n "$VERIFIER" | openssl dgst -sha256 -binary | base64 | tr '+/' '-_' | tr -d '=\n')
+    NONCE=$(openssl rand -hex 8)
+    local location=$(curl -s -o /dev/null -w '%{redirect_url}' -G "$AUTH_URL/oauth/authorize" \
+        --data-urlencode "response_type=code" \
+        --data-urlencode "client_id=$CLIENT_ID" \
+        --data-urlencode "redirect_uri=$REDIRECT_URI" \
+        --data-urlencode "scope=openid profile email" \
+        --data-urlencode "state=xyz" \
+        --data-urlencode "nonce=$NONCE" \
+        --data-urlencode "code_challenge=$CHALLENGE" \
+        --data-urlencode "code_challenge_method=S256")
+    REQUEST_ID=$(query_param "$location" request)
+}
+
+# approve approves a consent request as the user and returns the code.
+approve() {
+    local redirect=$(curl -s -X POST -H "Authorization: Bearer $USER_TOKEN" -H "Content-Type: application/json" \
+        -d '{"approve":true}' "$AUTH_URL/oauth/requests/$1" | jq -r '.redirect_to')
+    query_param "$redirect" code
+}
+
+redeem() {
+    curl -s -X POST -u "$CLIENT_ID:$CLIENT_SECRET" \
+        --data-urlencode "grant_type=authorization_code" \
+        --data-urlencode "code=$1" \
+        --data-urlencode "redirect_uri=$REDIRECT_URI" \
+        --data-urlencode "code_verifier=$2" \
+        "$AUTH_URL/oauth/token"
+}
+
+echo -e "\n${GREEN}3. Authorization code flow${NC}"
+authorize
+check "authorize redirects to the consent page" "$([ -n "$REQUEST_ID" ] && echo true)"
+DETAILS=$(curl -s -H "Authorization: Bearer $USER_TOKEN" "$AUTH_URL/oauth/requests/$REQUEST_ID")
+check "consent is required the first time" "$(echo "$DETAILS" | jq '.consent_required')"
+CODE=$(approve "$REQUEST_ID")
+check "approval returns a code" "$([ -n "$CODE" ] && echo true)"
+
+WRONG=$(redeem "$CODE" "not-the-verifier-not-the-verifier-not-the-verifier")
+check "wrong code_verifier is rejected" "$(echo "$WRONG" | jq '.error == "invalid_grant"')"
+
+authorize
+DETAILS=$(curl -s -H "Authorization: Bearer $USER_TOKEN" "$AUTH_URL/oauth/requests/$REQUEST_ID")
+check "consent is remembered" "$(echo "$DETAILS" | jq '.consent_required == false')"
+CODE=$(approve "$REQUEST_ID")
+TOKENS=$(redeem "$CODE" "$VERIFIER")
+ACCESS_TOKEN=$(echo "$TOKENS" | jq -r '.access_token')
+ID_TOKEN=$(echo "$TOKENS" | jq -r '.id_token')
+check "code exchange returns tokens" "$([ "$ACCESS_TOKEN" != "null" ] && [ "$ID_TOKEN" != "null" ] && echo true)"
+
+CLAIMS=$(b64url_decode "$(echo "$ID_TOKEN" | cut -d. -f2)")
+check "id_token audience is the client" "$(echo "$CLAIMS" | jq --arg c "$CLIENT_ID" '.aud == $c')"
+check "id_token carries the nonce" "$(echo "$CLAIMS" | jq --arg n "$NONCE" '.nonce == $n')"
+check "id_token has the username" "$(echo "$CLAIMS" | jq --arg u "$USER" '.preferred_username == $u')"
+
+REPLAY=$(redeem "$CODE" "$VERIFIER")
+check "a code works only once" "$(echo "$REPLAY" | jq '.error == "invalid_grant"')"
+
+echo -e "\n${GREEN}4. Userinfo${NC}"
+STATUS=$(curl -s -o /dev/null -w '%{http_code}' -H "Authorization: Bearer $ACCESS_TOKEN" "$AUTH_URL/oauth/userinfo")
+check "tokens of a replayed code are revoked" "$([ "$STATUS" = "401" ] && echo true)"
+
+authorize
+CODE=$(approve "$REQUEST_ID")
+ACCESS_TOKEN=$(redeem "$CODE" "$VERIFIER" | jq -r '.access_token')
+USERINFO=$(curl -s -H "Authorization: Bearer $ACCESS_TOKEN" "$AUTH_URL/oauth/userinfo")
+check "userinfo returns the email" "$(echo "$USERINFO" | jq '.email == "oidcuser@example.com"')"
+check "userinfo subject matches the id_token" "$(echo "$USERINFO" | jq --arg s "$(echo "$CLAIMS" | jq -r .sub)" '.sub == $s')"
+
+STATUS=$(curl -s -o /dev/null -w '%{http_code}' -H "Authorization: Bearer $ID_TOKEN" "$AUTH_URL/users/me")
+check "an id_token is not an access token" "$([ "$STATUS" = "401" ] && echo true)"
+
+echo -e "\n${GREEN}5. Cleanup${NC}"
+STATUS=$(curl -s -o /dev/null -w '%{http_code}' -X DELETE -H "Authorization: Bearer $ADMIN_TOKEN" \
+    "$AUTH_URL/admin/oauth/clients/$CLIENT_ID")
+check "client deleted" "$([ "$STATUS" = "204" ] && echo true)"
+
+if [ $FAILED -ne 0 ]; then
+    echo -e "\n${RED}OIDC tests failed${NC}"
+    exit 1
+fi
+echo -e "\n${GREEN}All OIDC tests passed! 🎉${NC}"
@@ -36,6 +36,10 @@ func main() {
 		log.Fatalf("Failed to ping PostgreSQL: %v", err)
 	}
 
+	// Load auth-service's signing keys and keep the token deny-list in sync
+	internal.StartJWKSRefresh()
+	internal.StartRevocationSync()
+
 	// Create repository and handler
 	repo := internal.NewTeamRepository(db)
 	handler := internal.NewTeamHandler(repo)
@@ -44,18 +48,23 @@ func main() {
 	r := mux.NewRouter()
 
 	// Team endpoints
-	r.HandleFunc("/teams", internal.AuthMiddleware(handler.CreateTeam)).Methods("POST")
+	r.HandleFunc("/teams", internal.AuthMiddleware(internal.RequireScope(handler.CreateTeam, "teams:write"))).Methods("POST")
 	r.HandleFunc("/teams/{id}", internal.AuthMiddleware(handler.GetTeam)).Methods("GET")
 	r.HandleFunc("/teams/user", internal.AuthMiddleware(handler.GetUserTeams)).Methods("GET")
-	r.HandleFunc("/teams/{id}", internal.AuthMiddleware(handler.UpdateTeam)).Methods("PUT")
-	r.HandleFunc("/teams/{id}", internal.AuthMiddleware(handler.DeleteTeam)).Methods("DELETE")
+	r.HandleFunc("/teams/{id}", internal.AuthMiddleware(internal.RequireScope(handler.UpdateTeam, "teams:write"))).Methods("PUT")
+	r.HandleFunc("/teams/{id}", internal.AuthMiddleware(internal.RequireScope(handler.DeleteTeam, "teams:write"))).Methods("DELETE")
 
 	// Team member endpoints
-	r.HandleFunc("/teams/invite", internal.AuthMiddleware(handler.InviteMember)).Methods("POST")
-	r.HandleFunc("/teams/invite/respond", internal.AuthMiddleware(handler.RespondToInvite)).Methods("POST")
-	r.HandleFunc("/teams/members/{teamId}/{username}", internal.AuthMiddleware(handler.RemoveMember)).Methods("DELETE")
+	r.HandleFunc("/teams/invite", internal.AuthMiddleware(internal.RequireScope(handler.InviteMember, "teams:write"))).Methods("POST")
+	r.HandleFunc("/teams/invite/respond", internal.AuthMiddleware(internal.RequireScope(handler.RespondToInvite, "teams:write"))).Methods("POST")
+	r.HandleFunc("/teams/members/{teamId}/{username}", internal.AuthMiddleware(internal.RequireScope(handler.RemoveMember, "teams:write"))).Methods("DELETE")
 	r.HandleFunc("/teams/invites", internal.AuthMiddleware(handler.GetUserInvites)).Methods("GET")
 
+	// Internal endpoints called by auth-service
+	r.HandleFunc("/internal/users/rename", internal.AuthMiddleware(internal.RequireRole(handler.RenameUser, "system"))).Methods("POST")
+	r.HandleFunc("/internal/users/erase", internal.AuthMiddleware(internal.RequireRole(handler.EraseUser, "system"))).Methods("POST")
+	r.HandleFunc("/internal/users/export", internal.AuthMiddleware(internal.RequireRole(handler.ExportUser, "system"))).Methods("POST")
+
 	// Health check endpoint
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// RenameUser applies a username change made in auth-service to team
+// memberships and invites. It is only reachable with auth-service's system
+// token and is safe to repeat.
+func (h *TeamHandler) RenameUser(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		OldUsername string `json:"old_username"`
+		NewUsername string `json:"new_username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.OldUsername == "" || request.NewUsername == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.repo.RenameUser(request.OldUsername, request.NewUsername); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EraseUser removes a user's team memberships and invites when their account
+// is deleted. It is only reachable with auth-service's system token and is
+// safe to repeat.
+func (h *TeamHandler) EraseUser(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Username == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := h.repo.EraseUser(request.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"deleted": deleted})
+}
+
+// ExportUser returns a user's team memberships and invites for their data
+// export. It is only reachable with auth-service's system token.
+func (h *TeamHandler) ExportUser(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Username == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	memberships, err := h.repo.GetUserMemberships(request.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	invites, err := h.repo.GetInvitesInvolving(request.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"team_memberships": memberships,
+		"team_invites":     invites,
+	})
+}
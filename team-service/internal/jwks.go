@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwksMinRefetch limits how often an unknown kid can trigger a refetch, so a
+// flood of forged tokens cannot turn into a flood of requests to auth-service.
+const jwksMinRefetch = 30 * time.Second
+
+// jwksCache holds auth-service's public signing keys by kid.
+type jwksCache struct {
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	lastAttempt time.Time
+}
+
+var signingKeys = &jwksCache{keys: make(map[string]*rsa.PublicKey)}
+
+// StartJWKSRefresh fetches the JWKS from auth-service and refreshes it every
+// JWKS_REFRESH_INTERVAL (default 5m) so that rotated keys are picked up.
+func StartJWKSRefresh() {
+	interval := 5 * time.Minute
+	if v, err := time.ParseDuration(os.Getenv("JWKS_REFRESH_INTERVAL")); err == nil && v > 0 {
+		interval = v
+	}
+
+	if err := signingKeys.fetch(); err != nil {
+		log.Printf("Initial JWKS fetch failed: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := signingKeys.fetch(); err != nil {
+				log.Printf("JWKS refresh failed: %v", err)
+			}
+		}
+	}()
+}
+
+func (c *jwksCache) fetch() error {
+	c.mu.Lock()
+	c.lastAttempt = time.Now()
+	c.mu.Unlock()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(getAuthServiceURL() + "/.well-known/jwks.json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from auth-service: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return fmt.Errorf("key %s: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return fmt.Errorf("key %s: %v", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *jwksCache) key(kid string) (*rsa.PublicKey, bool) {
+	c.mu.RLock()
+	key, ok := c.keys[kid]
+	canRefetch := time.Since(c.lastAttempt) > jwksMinRefetch
+	c.mu.RUnlock()
+	if ok || !canRefetch {
+		return key, ok
+	}
+
+	// A kid we have not seen usually means auth-service just rotated keys.
+	if err := c.fetch(); err != nil {
+		log.Printf("JWKS fetch for kid %q failed: %v", kid, err)
+		return nil, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	key, ok = c.keys[kid]
+	return key, ok
+}
+
+// jwtKeyFunc resolves the RS256 verification key for a token from the cached
+// JWKS. Tokens signed with any other algorithm are rejected.
+func jwtKeyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, ok := signingKeys.key(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
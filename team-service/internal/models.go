@@ -28,4 +28,11 @@ type TeamInvite struct {
 	Status          string    `json:"status"`
 	CreatedAt       time.Time `json:"created_at"`
 	UpdatedAt       time.Time `json:"updated_at"`
-} 
\ No newline at end of file
+} 
+// TeamMembership is one of a user's team memberships with the team's name.
+type TeamMembership struct {
+	TeamID   int       `json:"team_id"`
+	TeamName string    `json:"team_name"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
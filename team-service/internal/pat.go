@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// patPrefix marks personal access tokens issued by auth-service.
+const patPrefix = "pat_"
+
+// patInfo is auth-service's introspection answer for a personal access token.
+type patInfo struct {
+	Active        bool       `json:"active"`
+	Username      string     `json:"username"`
+	Roles         []string   `json:"roles"`
+	Scopes        []string   `json:"scopes"`
+	EmailVerified bool       `json:"email_verified"`
+	ExpiresAt     *time.Time `json:"expiresAt"`
+}
+
+type patCacheEntry struct {
+	info      patInfo
+	expiresAt time.Time
+}
+
+// patCache keeps introspection results for PAT_CACHE_TTL (default 30s), so a
+// busy CI job costs one call to auth-service per TTL instead of per request.
+// A revoked token therefore keeps working for at most one TTL.
+var patCache = struct {
+	sync.Mutex
+	entries map[string]patCacheEntry
+}{entries: make(map[string]patCacheEntry)}
+
+func patCacheTTL() time.Duration {
+	if v, err := time.ParseDuration(os.Getenv("PAT_CACHE_TTL")); err == nil && v > 0 {
+		return v
+	}
+	return 30 * time.Second
+}
+
+// isPAT reports whether a bearer token is a personal access token.
+func isPAT(token string) bool {
+	return strings.HasPrefix(token, patPrefix)
+}
+
+// introspectPAT validates a personal access token with auth-service.
+func introspectPAT(token string) (*patInfo, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	patCache.Lock()
+	entry, ok := patCache.entries[key]
+	patCache.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return &entry.info, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"token": token})
+	req, err := http.NewRequest(http.MethodPost, getAuthServiceURL()+"/tokens/introspect", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+getServiceAPIKey())
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from auth-service: %s", resp.Status)
+	}
+
+	var info patInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+
+	expiresAt := now.Add(patCacheTTL())
+	if info.ExpiresAt != nil && info.ExpiresAt.Before(expiresAt) {
+		expiresAt = *info.ExpiresAt
+	}
+
+	patCache.Lock()
+	for k, e := range patCache.entries {
+		if now.After(e.expiresAt) {
+			delete(patCache.entries, k)
+		}
+	}
+	patCache.entries[key] = patCacheEntry{info: info, expiresAt: expiresAt}
+	patCache.Unlock()
+
+	return &info, nil
+}
+
+// HasScope reports whether the request may act within scope. JWT sessions
+// carry every scope; personal access tokens only those they were created with.
+func HasScope(r *http.Request, scope string) bool {
+	for _, have := range strings.Split(r.Header.Get("scopes"), ",") {
+		if have == "*" || have == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope rejects personal access tokens that were not granted scope.
+// It must be wrapped by AuthMiddleware.
+func RequireScope(next http.HandlerFunc, scope string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !HasScope(r, scope) {
+			http.Error(w, "Token is missing scope "+scope, http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -283,4 +283,155 @@ func (r *TeamRepository) RemoveMember(teamID int, username string) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// RenameUser moves oldUsername's memberships and invites to newUsername in
+// one transaction.
+func (r *TeamRepository) RenameUser(oldUsername, newUsername string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		"UPDATE team_members SET username = $2 WHERE username = $1",
+		"UPDATE team_invites SET inviter_username = $2 WHERE inviter_username = $1",
+		"UPDATE team_invites SET invitee_username = $2 WHERE invitee_username = $1",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, oldUsername, newUsername); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// EraseUser removes username's memberships and invites. Teams left without
+// members are deleted; teams left without an admin get their longest
+// standing member promoted. It returns the number of removed rows by kind.
+func (r *TeamRepository) EraseUser(username string) (map[string]int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT team_id FROM team_members WHERE username = $1", username)
+	if err != nil {
+		return nil, err
+	}
+	var teamIDs []int
+	for rows.Next() {
+		var teamID int
+		if err := rows.Scan(&teamID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		teamIDs = append(teamIDs, teamID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	deleted := make(map[string]int64)
+	result, err := tx.Exec("DELETE FROM team_invites WHERE inviter_username = $1 OR invitee_username = $1", username)
+	if err != nil {
+		return nil, err
+	}
+	deleted["team_invites"], _ = result.RowsAffected()
+
+	result, err = tx.Exec("DELETE FROM team_members WHERE username = $1", username)
+	if err != nil {
+		return nil, err
+	}
+	deleted["team_members"], _ = result.RowsAffected()
+
+	for _, teamID := range teamIDs {
+		result, err := tx.Exec(`
+			DELETE FROM teams
+			WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM team_members WHERE team_id = $1)
+		`, teamID)
+		if err != nil {
+			return nil, err
+		}
+		n, _ := result.RowsAffected()
+		deleted["teams"] += n
+		if n > 0 {
+			continue
+		}
+
+		_, err = tx.Exec(`
+			UPDATE team_members SET role = 'admin'
+			WHERE team_id = $1
+			  AND username = (SELECT username FROM team_members WHERE team_id = $1 ORDER BY joined_at LIMIT 1)
+			  AND NOT EXISTS (SELECT 1 FROM team_members WHERE team_id = $1 AND role = 'admin')
+		`, teamID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// GetUserMemberships returns every team membership of username.
+func (r *TeamRepository) GetUserMemberships(username string) ([]TeamMembership, error) {
+	rows, err := r.db.Query(`
+		SELECT t.id, t.name, tm.role, tm.joined_at
+		FROM team_members tm
+		INNER JOIN teams t ON t.id = tm.team_id
+		WHERE tm.username = $1
+		ORDER BY tm.joined_at
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []TeamMembership{}
+	for rows.Next() {
+		var m TeamMembership
+		if err := rows.Scan(&m.TeamID, &m.TeamName, &m.Role, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, m)
+	}
+
+	return memberships, rows.Err()
+}
+
+// GetInvitesInvolving returns every invite username sent or received,
+// whatever its status.
+func (r *TeamRepository) GetInvitesInvolving(username string) ([]TeamInvite, error) {
+	rows, err := r.db.Query(`
+		SELECT id, team_id, inviter_username, invitee_username, status, created_at, updated_at
+		FROM team_invites
+		WHERE inviter_username = $1 OR invitee_username = $1
+		ORDER BY created_at
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []TeamInvite{}
+	for rows.Next() {
+		var invite TeamInvite
+		err := rows.Scan(
+			&invite.ID, &invite.TeamID, &invite.InviterUsername,
+			&invite.InviteeUsername, &invite.Status, &invite.CreatedAt, &invite.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+
+	return invites, rows.Err()
+}